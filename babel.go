@@ -2,10 +2,8 @@ package connutil
 
 import (
 	"io"
-	"io/ioutil"
 	"net"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -13,74 +11,166 @@ import (
 // the Conn is closed.
 // Read calls is equivalent to source.Read, until either the ReadDeadline is reached or the Conn is closed
 //
-// Do Babel(rand.Reader) to get a net.Conn that reads random data
+// Do Babel(rand.Reader) to get a net.Conn that reads random data.
+//
+// source.Read is called in the background, so a Read blocked in a slow source still returns as soon as the Conn is
+// closed or the ReadDeadline is reached. The data of a source.Read call interrupted in this way is returned by the
+// next Read. If source returns io.ErrClosedPipe, the Conn closes itself. Sources that never block, such as a
+// NullReader without a rate limit, a PRNGReader or a PatternReader, are read directly instead.
+//
+// The background goroutine only exits once source.Read returns, so a source that never returns leaves a goroutine
+// behind after the Conn is closed. A NullReader with a rate limit gives up waiting as soon as the Conn is closed.
 func Babel(source io.Reader) net.Conn {
-	return &babelConn{Source: source}
+	b := &babelConn{Source: source, done: make(chan struct{})}
+	b.rCond.L = &b.mu
+	return b
+}
+
+// cancellableReader is implemented by sources that can give up waiting once cancel is closed
+type cancellableReader interface {
+	read(b []byte, cancel <-chan struct{}) (int, error)
+}
+
+// nonBlockingReader is implemented by sources that can be read without going through a background goroutine
+type nonBlockingReader interface {
+	nonBlocking() bool
 }
 
 type babelConn struct {
-	closed uint32
 	Source io.Reader
 
-	deadlineM sync.RWMutex
+	mu     sync.Mutex
+	rCond  sync.Cond
+	closed bool
+	done   chan struct{}
+	// pending is set while a source.Read call is in progress
+	pending bool
+	// data and err hold the result of source.Read not yet returned by Read. data is a slice of buf, which is reused
+	// by every source.Read call in the background.
+	data []byte
+	err  error
+	buf  []byte
+
 	rDeadline time.Time
 	wDeadline time.Time
 }
 
-func (b *babelConn) Read(buf []byte) (int, error) {
-	if atomic.LoadUint32(&b.closed) == 1 {
-		return 0, io.ErrClosedPipe
+// fill calls source.Read, and must be called with b.mu held
+func (b *babelConn) fill(size int) {
+	b.pending = true
+	if cap(b.buf) < size {
+		b.buf = make([]byte, size)
 	}
-	b.deadlineM.RLock()
-	defer b.deadlineM.RUnlock()
-	if !b.rDeadline.IsZero() {
-		delta := time.Until(b.rDeadline)
-		if delta <= 0 {
-			return 0, ErrTimeout
+	buf := b.buf[:size]
+	go func() {
+		var n int
+		var err error
+		if source, ok := b.Source.(cancellableReader); ok {
+			n, err = source.read(buf, b.done)
+		} else {
+			n, err = b.Source.Read(buf)
 		}
-	}
 
-	return b.Source.Read(buf)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.pending = false
+		b.data, b.err = buf[:n], err
+		b.rCond.Broadcast()
+	}()
+}
+
+func (b *babelConn) Read(buf []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		if b.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if len(b.data) > 0 || b.err != nil {
+			n := copy(buf, b.data)
+			b.data = b.data[n:]
+			if len(b.data) > 0 {
+				return n, nil
+			}
+			err := b.err
+			b.err = nil
+			if err == io.ErrClosedPipe {
+				b.close()
+			}
+			return n, err
+		}
+		if !b.rDeadline.IsZero() {
+			delta := time.Until(b.rDeadline)
+			if delta <= 0 {
+				return 0, ErrTimeout
+			}
+			time.AfterFunc(delta, b.rCond.Broadcast)
+		}
+		if !b.pending {
+			if len(buf) == 0 {
+				return 0, nil
+			}
+			if source, ok := b.Source.(nonBlockingReader); ok && source.nonBlocking() {
+				n, err := b.Source.Read(buf)
+				if err == io.ErrClosedPipe {
+					b.close()
+				}
+				return n, err
+			}
+			b.fill(len(buf))
+		}
+		b.rCond.Wait()
+	}
 }
 
 func (b *babelConn) Write(buf []byte) (int, error) {
-	if atomic.LoadUint32(&b.closed) == 1 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
 		return 0, io.ErrClosedPipe
 	}
-	b.deadlineM.RLock()
-	defer b.deadlineM.RUnlock()
-	if !b.wDeadline.IsZero() {
-		delta := time.Until(b.wDeadline)
-		if delta <= 0 {
-			return 0, ErrTimeout
-		}
+	if !b.wDeadline.IsZero() && time.Until(b.wDeadline) <= 0 {
+		return 0, ErrTimeout
 	}
-	return ioutil.Discard.Write(buf)
+	return len(buf), nil
+}
+
+// close must be called with b.mu held
+func (b *babelConn) close() {
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+	b.rCond.Broadcast()
 }
 
 func (b *babelConn) Close() error {
-	atomic.SwapUint32(&b.closed, 1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.close()
 	return nil
 }
 func (b *babelConn) SetReadDeadline(t time.Time) error {
-	b.deadlineM.Lock()
-	defer b.deadlineM.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
 	b.rDeadline = t
+	b.rCond.Broadcast()
 	return nil
 }
 func (b *babelConn) SetWriteDeadline(t time.Time) error {
-	b.deadlineM.Lock()
-	defer b.deadlineM.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
 	b.wDeadline = t
 	return nil
 }
 func (b *babelConn) SetDeadline(t time.Time) error {
-	b.deadlineM.Lock()
-	defer b.deadlineM.Unlock()
-	b.rDeadline = t
-	b.wDeadline = t
+	_ = b.SetReadDeadline(t)
+	_ = b.SetWriteDeadline(t)
 	return nil
 }
 func (b *babelConn) LocalAddr() net.Addr  { return fakeAddr{} }
@@ -155,3 +155,78 @@ func TestBabelConn_Addrs(t *testing.T) {
 		t.Error("RemoteAddr shouldn't return null pointer")
 	}
 }
+
+func TestBabelConn_BlockedSource(t *testing.T) {
+	t.Run("close while blocked", func(t *testing.T) {
+		source, _ := AsyncPipe()
+		b := Babel(source)
+		done := make(chan error)
+		go func() {
+			_, err := b.Read(make([]byte, 1))
+			done <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		_ = b.Close()
+		select {
+		case err := <-done:
+			if err != io.ErrClosedPipe {
+				t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Read did not unblock after Close")
+		}
+	})
+
+	t.Run("deadline while blocked", func(t *testing.T) {
+		source, _ := AsyncPipe()
+		b := Babel(source)
+		done := make(chan error)
+		go func() {
+			_, err := b.Read(make([]byte, 1))
+			done <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		_ = b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		select {
+		case err := <-done:
+			if err != ErrTimeout {
+				t.Errorf("expecting %v, got %v", ErrTimeout, err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Read did not unblock after deadline has passed")
+		}
+	})
+
+	t.Run("non-blocking source", func(t *testing.T) {
+		b := Babel(&NullReader{})
+		buf := make([]byte, 64*1024)
+		allocs := testing.AllocsPerRun(100, func() {
+			if n, err := b.Read(buf); err != nil || n != len(buf) {
+				t.Errorf("expecting %v bytes and no error, got %v and %v", len(buf), n, err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("expecting no allocations, got %v", allocs)
+		}
+	})
+
+	t.Run("data from interrupted read is kept", func(t *testing.T) {
+		source, writer := AsyncPipe()
+		b := Babel(source)
+		_ = b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := b.Read(make([]byte, 4))
+		if err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+		_ = b.SetReadDeadline(time.Time{})
+		_, _ = writer.Write([]byte("data"))
+		buf := make([]byte, 4)
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(buf[:n]) != "data" {
+			t.Errorf("expecting %v, got %v", "data", string(buf[:n]))
+		}
+	})
+}
@@ -1,112 +1,260 @@
 package connutil
 
 import (
-	"bytes"
+	"context"
 	"io"
+	"net"
 	"sync"
+	"syscall"
 	"time"
 )
 
 // softLimit == 0 means no limit
 func newBufferedPacketPipe(softLimit int) *bufferedPacketPipe {
-	p := &bufferedPacketPipe{softLimit: softLimit}
+	p := &bufferedPacketPipe{softLimit: softLimit, lastActive: time.Now()}
 	p.rCond.L = &p.mu
 	p.wCond.L = &p.mu
 	return p
 }
 
+type packet struct {
+	data []byte
+	oob  []byte
+	// addr is the source address seen by the reader
+	addr net.Addr
+}
+
 type bufferedPacketPipe struct {
 	softLimit int
-	mu        sync.Mutex
-	pLens     []int
-	buf       bytes.Buffer
-	closed    bool
+	// mtu == 0 means no limit
+	mtu int
+	// truncate makes reads into short buffers truncate the packet instead of failing
+	truncate bool
+	// lossy pipes drop packets instead of blocking writers when the buffer is full
+	lossy   bool
+	mu      sync.Mutex
+	packets []packet
+	// buffered is the total size of the data of all packets in the pipe
+	buffered int
+	closed   bool
+	// err overrides io.ErrClosedPipe as the error returned after the pipe is closed
+	err error
+	// frozen pipes hold on to the packets written, until unfrozen
+	frozen    bool
 	rCond     sync.Cond
 	wCond     sync.Cond
 	rDeadline time.Time
 	wDeadline time.Time
+	stats     DirectionStats
+	// lastActive is the time data is last written or read
+	lastActive time.Time
+	// waitingReaders and waitingWriters count the goroutines blocked in Read and Write
+	waitingReaders int
+	waitingWriters int
+
+	hooks  *Hooks
+	writer ConnID
+	reader ConnID
 }
 
 func (p *bufferedPacketPipe) Read(b []byte) (int, error) {
+	n, _, _, _, err := p.ReadMsg(b, nil)
+	return n, err
+}
+
+// ReadMsg reads a packet into b and its out-of-band data into oob. flags has msgTrunc set if the packet is truncated
+// to fit into b, and msgCtrunc set if the out-of-band data is truncated to fit into oob.
+func (p *bufferedPacketPipe) ReadMsg(b, oob []byte) (n, oobn, flags int, addr net.Addr, err error) {
+	return p.ReadMsgContext(context.Background(), b, oob)
+}
+
+// ReadMsgContext behaves like ReadMsg, but returns ctx.Err() once ctx is done
+func (p *bufferedPacketPipe) ReadMsgContext(ctx context.Context, b, oob []byte) (n, oobn, flags int, addr net.Addr, err error) {
+	defer wakeOnDone(ctx, &p.rCond)()
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	n, oobn, flags, addr, err = p.read(ctx, b, oob)
+	buffered := p.buffered
+	p.mu.Unlock()
+
+	p.hooks.fireIO(HookRead, p.reader, n, buffered, err)
+	return
+}
 
+// read must be called with p.mu held
+func (p *bufferedPacketPipe) read(ctx context.Context, b, oob []byte) (n, oobn, flags int, addr net.Addr, err error) {
 	for {
+		if ctx.Err() != nil {
+			return 0, 0, 0, nil, ctx.Err()
+		}
 		if !p.rDeadline.IsZero() {
 			d := time.Until(p.rDeadline)
 			if d <= 0 {
-				return 0, ErrTimeout
+				p.stats.ReadTimeouts++
+				return 0, 0, 0, nil, ErrTimeout
 			}
 			time.AfterFunc(d, p.rCond.Broadcast)
 		}
-		if len(p.pLens) > 0 {
+		if len(p.packets) > 0 && !p.frozen {
 			break
 		}
 		if p.closed {
-			return 0, io.ErrClosedPipe
+			return 0, 0, 0, nil, p.closeErr()
 		}
+		p.waitingReaders++
 		p.rCond.Wait()
+		p.waitingReaders--
 	}
 
-	curLen := p.pLens[0]
-	if curLen > len(b) {
-		return 0, io.ErrShortBuffer
+	pkt := p.packets[0]
+	if len(pkt.data) > len(b) {
+		if !p.truncate {
+			return 0, 0, 0, nil, io.ErrShortBuffer
+		}
+		flags |= msgTrunc
+	}
+	if len(pkt.oob) > len(oob) {
+		flags |= msgCtrunc
 	}
-	n, _ := p.buf.Read(b[:curLen])
-	p.pLens = p.pLens[1:]
+	n = copy(b, pkt.data)
+	oobn = copy(oob, pkt.oob)
+	p.packets[0] = packet{}
+	p.packets = p.packets[1:]
+	p.buffered -= len(pkt.data)
+	p.stats.BytesRead += int64(n)
+	p.stats.PacketsRead++
+	p.lastActive = time.Now()
 	p.wCond.Broadcast()
 	if p.closed {
-		return n, io.ErrClosedPipe
+		return n, oobn, flags, pkt.addr, p.closeErr()
 	}
-	// err is either io.EOF or nil. Since the buffer is definitely not empty, err is nil
-	return n, nil
+	return n, oobn, flags, pkt.addr, nil
 }
 
 func (p *bufferedPacketPipe) Write(b []byte) (int, error) {
+	return p.WriteMsg(b, nil, nil)
+}
+
+// WriteMsg writes a packet carrying the out-of-band data oob. The reader sees addr as the source address.
+func (p *bufferedPacketPipe) WriteMsg(b, oob []byte, addr net.Addr) (int, error) {
+	return p.WriteMsgContext(context.Background(), b, oob, addr)
+}
+
+// WriteMsgContext behaves like WriteMsg, but returns ctx.Err() once ctx is done
+func (p *bufferedPacketPipe) WriteMsgContext(ctx context.Context, b, oob []byte, addr net.Addr) (int, error) {
+	defer wakeOnDone(ctx, &p.wCond)()
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	n, blocked, err := p.write(ctx, b, oob, addr)
+	buffered := p.buffered
+	p.mu.Unlock()
 
-	if p.softLimit != 0 && len(b) > p.softLimit {
-		return 0, ErrWriteToLarge
+	if blocked {
+		p.hooks.fire(HookEvent{Op: HookUnblock, Conn: p.writer, Buffered: buffered})
+	}
+	p.hooks.fireIO(HookWrite, p.writer, n, buffered, err)
+	return n, err
+}
+
+// write must be called with p.mu held. It reports whether it has blocked on the buffer size limit.
+func (p *bufferedPacketPipe) write(ctx context.Context, b, oob []byte, addr net.Addr) (n int, blocked bool, err error) {
+	if p.mtu != 0 && len(b) > p.mtu {
+		return 0, blocked, syscall.EMSGSIZE
+	}
+	if p.softLimit != 0 && len(b) > p.softLimit && !p.lossy {
+		return 0, blocked, ErrWriteToLarge
 	}
 
 	for {
 		if p.closed {
-			return 0, io.ErrClosedPipe
+			return 0, blocked, p.closeErr()
+		}
+		if ctx.Err() != nil {
+			return 0, blocked, ctx.Err()
 		}
 		if !p.wDeadline.IsZero() {
 			d := time.Until(p.wDeadline)
 			if d <= 0 {
-				return 0, ErrTimeout
+				p.stats.WriteTimeouts++
+				return 0, blocked, ErrTimeout
 			}
 			time.AfterFunc(d, p.wCond.Broadcast)
 		}
 		if p.softLimit == 0 {
 			break
 		} else {
-			if p.buf.Len() <= p.softLimit {
+			if p.buffered <= p.softLimit && len(b) <= p.softLimit {
 				break
 			}
+			if p.lossy {
+				p.stats.Dropped++
+				return len(b), blocked, nil
+			}
+			if !blocked {
+				blocked = true
+				p.stats.WriteBlocks++
+				if p.hooks != nil {
+					buffered := p.buffered
+					p.mu.Unlock()
+					p.hooks.fire(HookEvent{Op: HookBlock, Conn: p.writer, Buffered: buffered})
+					p.mu.Lock()
+					// conditions need to be checked again after the lock is reacquired
+					continue
+				}
+			}
+			p.waitingWriters++
 			p.wCond.Wait()
+			p.waitingWriters--
 		}
 	}
 
-	p.pLens = append(p.pLens, len(b))
-	p.buf.Write(b)
-	// err is always nil
+	p.packets = append(p.packets, packet{
+		data: append([]byte(nil), b...),
+		oob:  append([]byte(nil), oob...),
+		addr: addr,
+	})
+	p.buffered += len(b)
+	p.stats.BytesWritten += int64(len(b))
+	p.stats.PacketsWritten++
+	p.lastActive = time.Now()
+	if p.buffered > p.stats.PeakBuffered {
+		p.stats.PeakBuffered = p.buffered
+	}
 	p.rCond.Broadcast()
-	return len(b), nil
+	return len(b), blocked, nil
+}
+
+func (p *bufferedPacketPipe) closeErr() error {
+	if p.err != nil {
+		return p.err
+	}
+	return io.ErrClosedPipe
 }
 
 func (p *bufferedPacketPipe) Close() {
+	p.CloseWithError(nil)
+}
+
+// CloseWithError closes the pipe, after which Read and Write return err. A nil err means io.ErrClosedPipe.
+func (p *bufferedPacketPipe) CloseWithError(err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	p.closed = true
+	if !p.closed {
+		p.closed = true
+		p.err = err
+	}
 	p.rCond.Broadcast()
 	p.wCond.Broadcast()
 }
 
+// SetFrozen stops or resumes the delivery of packets to the reader. Writes still succeed until the buffer is full.
+func (p *bufferedPacketPipe) SetFrozen(frozen bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.frozen = frozen
+	p.rCond.Broadcast()
+}
+
 func (p *bufferedPacketPipe) SetReadDeadline(t time.Time) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -122,3 +270,26 @@ func (p *bufferedPacketPipe) SetWriteDeadline(t time.Time) {
 	p.wDeadline = t
 	p.wCond.Broadcast()
 }
+
+func (p *bufferedPacketPipe) Stats() DirectionStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Buffered = p.buffered
+	return stats
+}
+
+// leakState reports whether the pipe is closed, and the number of goroutines blocked on it
+func (p *bufferedPacketPipe) leakState() (closed bool, waiting int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed, p.waitingReaders + p.waitingWriters
+}
+
+// activity reports the time data is last written or read, and whether the pipe is frozen or closed
+func (p *bufferedPacketPipe) activity() (lastActive time.Time, frozen, closed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastActive, p.frozen, p.closed
+}
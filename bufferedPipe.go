@@ -36,6 +36,7 @@ package connutil
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"sync"
 	"time"
@@ -43,7 +44,7 @@ import (
 
 // softLimit == 0 means no limit
 func newBufferedPipe(softLimit int) *bufferedPipe {
-	p := &bufferedPipe{softLimit: softLimit}
+	p := &bufferedPipe{softLimit: softLimit, lastActive: time.Now()}
 	p.rCond.L = &p.mu
 	p.wCond.L = &p.mu
 	return p
@@ -51,78 +52,397 @@ func newBufferedPipe(softLimit int) *bufferedPipe {
 
 type bufferedPipe struct {
 	softLimit int
-	mu        sync.Mutex
-	buf       bytes.Buffer
-	closed    bool
+	// strict turns softLimit into a hard capacity. Writes are accepted as space becomes available.
+	strict bool
+	// rcvWindow is the size of the receive buffer, 0 means unlimited. If it is set, data written is held in the
+	// send buffer, sendBuf, until there is room for it in the receive buffer, buf, and softLimit only applies to the
+	// send buffer. Otherwise, softLimit applies to buf.
+	rcvWindow int
+	sendBuf   bytes.Buffer
+	// zeroWindow is set while data is held back by a closed receive window
+	zeroWindow bool
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	closed     bool
+	// eof is set when the writing side shuts down. Read returns io.EOF once the buffer is drained.
+	eof bool
+	// readShut is set when the reading side shuts down. Read returns io.EOF, and data written is discarded.
+	readShut bool
+	// err overrides io.ErrClosedPipe as the error returned after the pipe is closed
+	err error
+	// readErr and writeErr, once set, are returned by Read and Write only, leaving the other side of the pipe untouched
+	readErr  error
+	writeErr error
+	// frozen pipes hold on to the data written, until unfrozen
+	frozen    bool
 	rCond     sync.Cond
 	wCond     sync.Cond
 	rDeadline time.Time
 	wDeadline time.Time
+	stats     DirectionStats
+	// segmentSize limits the size of each Read, 0 means no limit. If segmentRand is set, the limit of each Read is
+	// instead drawn from it, between 1 and segmentSize.
+	segmentSize int
+	segmentRand *PRNGReader
+	// lowWater is the amount of data Read waits for before returning, 0 means any amount. Read waits for at most
+	// coalesceDelay after the first byte lands in an empty buffer, that is, until flushAt.
+	lowWater      int
+	coalesceDelay time.Duration
+	flushAt       time.Time
+	// lastActive is the time data is last written or read
+	lastActive time.Time
+	// waitingReaders and waitingWriters count the goroutines blocked in Read and Write
+	waitingReaders int
+	waitingWriters int
+
+	hooks  *Hooks
+	writer ConnID
+	reader ConnID
 }
 
 func (p *bufferedPipe) Read(b []byte) (int, error) {
+	return p.ReadContext(context.Background(), b)
+}
+
+// ReadContext behaves like Read, but returns ctx.Err() once ctx is done
+func (p *bufferedPipe) ReadContext(ctx context.Context, b []byte) (int, error) {
+	defer wakeOnDone(ctx, &p.rCond)()
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	n, err := p.read(ctx, b)
+	buffered := p.buffered()
+	p.mu.Unlock()
+
+	p.hooks.fireIO(HookRead, p.reader, n, buffered, err)
+	return n, err
+}
+
+// read must be called with p.mu held
+func (p *bufferedPipe) read(ctx context.Context, b []byte) (int, error) {
+	segment := p.nextSegment()
+	if segment > 0 && segment < len(b) {
+		b = b[:segment]
+	}
+	// the amount of data to wait for
+	threshold := 1
+	if p.lowWater > threshold {
+		threshold = p.lowWater
+		if threshold > len(b) {
+			threshold = len(b)
+		}
+	}
 
 	for {
+		if p.readErr != nil {
+			return 0, p.readErr
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if p.readShut && !p.closed {
+			return 0, io.EOF
+		}
 		if !p.rDeadline.IsZero() {
 			d := time.Until(p.rDeadline)
 			if d <= 0 {
+				if p.lowWater > 0 && !p.frozen && p.buf.Len() > 0 {
+					// give up waiting for more data, and deliver what is there
+					break
+				}
+				p.stats.ReadTimeouts++
 				return 0, ErrTimeout
 			}
 			time.AfterFunc(d, p.rCond.Broadcast)
 		}
-		if p.closed || p.buf.Len() > 0 {
+		if p.closed || !p.frozen && (p.eof || p.buf.Len() > 0 && p.buf.Len() >= threshold) {
 			break
 		}
+		if p.lowWater > 0 && !p.frozen && p.buf.Len() > 0 {
+			d := time.Until(p.flushAt)
+			if d <= 0 {
+				// waited long enough for more data, deliver what is there
+				break
+			}
+			time.AfterFunc(d, p.rCond.Broadcast)
+		}
+		p.waitingReaders++
 		p.rCond.Wait()
+		p.waitingReaders--
+	}
+	if p.frozen {
+		// closed while frozen. Nothing buffered will ever be delivered.
+		return 0, p.closeErr()
 	}
 
 	n, _ := p.buf.Read(b)
+	// advertise the window opened up
+	p.transfer()
+	if n > 0 {
+		p.stats.BytesRead += int64(n)
+		p.stats.PacketsRead++
+		p.lastActive = time.Now()
+	}
 	p.wCond.Broadcast()
-	if p.closed {
-		return n, io.ErrClosedPipe
+	// once the writer has shut down gracefully, closing the pipe doesn't stop the data written from being read
+	if p.closed && !(p.eof && p.err == nil) {
+		return n, p.closeErr()
+	}
+	if n == 0 && p.eof {
+		return 0, io.EOF
 	}
 	// err is either io.EOF or nil. Since the buffer is definitely not empty, err is nil
 	return n, nil
 }
 
 func (p *bufferedPipe) Write(b []byte) (int, error) {
+	return p.WriteContext(context.Background(), b)
+}
+
+// WriteContext behaves like Write, but returns ctx.Err() once ctx is done
+func (p *bufferedPipe) WriteContext(ctx context.Context, b []byte) (int, error) {
+	defer wakeOnDone(ctx, &p.wCond)()
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	n, blocked, err := p.write(ctx, b)
+	buffered := p.buffered()
+	p.mu.Unlock()
 
+	if blocked {
+		p.hooks.fire(HookEvent{Op: HookUnblock, Conn: p.writer, Buffered: buffered})
+	}
+	p.hooks.fireIO(HookWrite, p.writer, n, buffered, err)
+	return n, err
+}
+
+// write must be called with p.mu held. It reports whether it has blocked on the buffer size limit.
+// In strict mode, n may be less than len(b) if an error occurs after part of b is written.
+func (p *bufferedPipe) write(ctx context.Context, b []byte) (n int, blocked bool, err error) {
 	for {
+		if p.writeErr != nil {
+			return n, blocked, p.writeErr
+		}
 		if p.closed {
-			return 0, io.ErrClosedPipe
+			return n, blocked, p.closeErr()
+		}
+		if p.eof {
+			return n, blocked, io.ErrClosedPipe
+		}
+		if p.readShut {
+			// nobody will ever read it
+			return len(b), blocked, nil
+		}
+		if ctx.Err() != nil {
+			return n, blocked, ctx.Err()
 		}
 		if !p.wDeadline.IsZero() {
 			d := time.Until(p.wDeadline)
 			if d <= 0 {
-				return 0, ErrTimeout
+				p.stats.WriteTimeouts++
+				return n, blocked, ErrTimeout
 			}
 			time.AfterFunc(d, p.wCond.Broadcast)
 		}
 		if p.softLimit == 0 {
 			break
 		} else {
-			if p.buf.Len() <= p.softLimit {
+			if p.strict {
+				if len(b) == 0 {
+					return 0, blocked, nil
+				}
+				if space := p.softLimit - p.sendLen(); space > 0 {
+					chunk := b[n:]
+					if len(chunk) > space {
+						chunk = chunk[:space]
+					}
+					p.append(chunk, n == 0)
+					n += len(chunk)
+					if n == len(b) {
+						return n, blocked, nil
+					}
+					// there may be room for more after the data is transferred to the receive buffer
+					continue
+				}
+			} else if p.sendLen() <= p.softLimit {
 				break
 			}
+			if !blocked {
+				blocked = true
+				p.stats.WriteBlocks++
+				if p.hooks != nil {
+					buffered := p.buffered()
+					p.mu.Unlock()
+					p.hooks.fire(HookEvent{Op: HookBlock, Conn: p.writer, Buffered: buffered})
+					p.mu.Lock()
+					// conditions need to be checked again after the lock is reacquired
+					continue
+				}
+			}
+			p.waitingWriters++
 			p.wCond.Wait()
+			p.waitingWriters--
 		}
 	}
 
-	p.buf.Write(b)
+	p.append(b, true)
+	return len(b), blocked, nil
+}
+
+// append adds b to the buffer. first is set if b is the first part of the data of a Write call.
+func (p *bufferedPipe) append(b []byte, first bool) {
+	if p.rcvWindow > 0 {
+		p.sendBuf.Write(b)
+		p.transfer()
+	} else {
+		p.writeBuf(b)
+	}
 	// err is always nil
+	p.stats.BytesWritten += int64(len(b))
+	p.lastActive = time.Now()
+	if first {
+		p.stats.PacketsWritten++
+	}
+	if p.buffered() > p.stats.PeakBuffered {
+		p.stats.PeakBuffered = p.buffered()
+	}
+	p.rCond.Broadcast()
+}
+
+// writeBuf adds b to the receive buffer. If the buffer was empty, the coalescing delay starts.
+func (p *bufferedPipe) writeBuf(b []byte) {
+	if p.buf.Len() == 0 && len(b) > 0 {
+		p.flushAt = time.Now().Add(p.coalesceDelay)
+	}
+	p.buf.Write(b)
+}
+
+// buffered returns the amount of data in the pipe, in both the send buffer and the receive buffer
+func (p *bufferedPipe) buffered() int {
+	return p.sendBuf.Len() + p.buf.Len()
+}
+
+// sendLen returns the amount of data the buffer size limit applies to
+func (p *bufferedPipe) sendLen() int {
+	if p.rcvWindow > 0 {
+		return p.sendBuf.Len()
+	}
+	return p.buf.Len()
+}
+
+// transfer moves as much data from the send buffer to the receive buffer as the receive window allows
+func (p *bufferedPipe) transfer() {
+	window := p.sendBuf.Len()
+	if p.rcvWindow > 0 {
+		window = p.rcvWindow - p.buf.Len()
+	}
+	if window <= 0 {
+		if p.sendBuf.Len() > 0 && !p.zeroWindow {
+			p.zeroWindow = true
+			p.stats.ZeroWindows++
+		}
+		return
+	}
+	p.zeroWindow = false
+	if p.sendBuf.Len() == 0 {
+		return
+	}
+	p.writeBuf(p.sendBuf.Next(window))
 	p.rCond.Broadcast()
-	return len(b), nil
+	p.wCond.Broadcast()
+}
+
+// SetSendBuffer changes the size of the send buffer, that is, the buffer size limit
+func (p *bufferedPipe) SetSendBuffer(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.softLimit = size
+	p.wCond.Broadcast()
+}
+
+// SetReceiveWindow changes the size of the receive buffer. 0 means unlimited.
+func (p *bufferedPipe) SetReceiveWindow(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rcvWindow = size
+	p.transfer()
+}
+
+// nextSegment returns the maximum size of the next Read, 0 means no limit
+func (p *bufferedPipe) nextSegment() int {
+	if p.segmentRand != nil && p.segmentSize > 0 {
+		return int(p.segmentRand.next()%uint64(p.segmentSize)) + 1
+	}
+	return p.segmentSize
+}
+
+func (p *bufferedPipe) closeErr() error {
+	if p.err != nil {
+		return p.err
+	}
+	return io.ErrClosedPipe
 }
 
 func (p *bufferedPipe) Close() {
+	p.CloseWithError(nil)
+}
+
+// CloseWithError closes the pipe, after which Read and Write return err. A nil err means io.ErrClosedPipe.
+func (p *bufferedPipe) CloseWithError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		p.err = err
+	}
+	p.rCond.Broadcast()
+	p.wCond.Broadcast()
+}
+
+// FailRead makes Read return err from now on. The writing side is not notified.
+func (p *bufferedPipe) FailRead(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readErr = err
+	p.rCond.Broadcast()
+}
+
+// FailWrite makes Write return err from now on. The reading side is not notified.
+func (p *bufferedPipe) FailWrite(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.writeErr = err
+	p.wCond.Broadcast()
+}
+
+// SetFrozen stops or resumes the delivery of data to the reader. Writes still succeed until the buffer is full.
+func (p *bufferedPipe) SetFrozen(frozen bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.frozen = frozen
+	p.rCond.Broadcast()
+}
+
+// CloseWrite shuts down the writing side. Data already written can still be read, after which Read returns io.EOF.
+func (p *bufferedPipe) CloseWrite() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.eof = true
+	p.rCond.Broadcast()
+	p.wCond.Broadcast()
+}
+
+// CloseRead shuts down the reading side. Read returns io.EOF, and data written afterwards is discarded.
+func (p *bufferedPipe) CloseRead() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	p.closed = true
+	p.readShut = true
+	p.buf.Reset()
+	p.sendBuf.Reset()
 	p.rCond.Broadcast()
 	p.wCond.Broadcast()
 }
@@ -142,3 +462,26 @@ func (p *bufferedPipe) SetWriteDeadline(t time.Time) {
 	p.wDeadline = t
 	p.wCond.Broadcast()
 }
+
+func (p *bufferedPipe) Stats() DirectionStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Buffered = p.buffered()
+	return stats
+}
+
+// leakState reports whether the pipe is closed, and the number of goroutines blocked on it
+func (p *bufferedPipe) leakState() (closed bool, waiting int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed, p.waitingReaders + p.waitingWriters
+}
+
+// activity reports the time data is last written or read, and whether the pipe is frozen or closed
+func (p *bufferedPipe) activity() (lastActive time.Time, frozen, closed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastActive, p.frozen, p.closed
+}
@@ -0,0 +1,45 @@
+package connutil
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// wakeOnDone broadcasts cond once ctx is done, so that goroutines waiting on it can check ctx.Err(). The returned
+// function stops it.
+func wakeOnDone(ctx context.Context, cond *sync.Cond) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	return context.AfterFunc(ctx, func() {
+		// holding the lock makes sure the broadcast isn't missed by a goroutine about to wait
+		cond.L.Lock()
+		cond.Broadcast()
+		cond.L.Unlock()
+	})
+}
+
+// BindContext returns a net.Conn wrapping conn, which is closed once ctx is done. This ties the lifetime of any
+// net.Conn to a test or a request. Closing the returned conn before ctx is done releases the resources associated with
+// the binding.
+func BindContext(conn net.Conn, ctx context.Context) net.Conn {
+	c := &boundConn{Conn: conn}
+	c.stop = context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	return c
+}
+
+type boundConn struct {
+	net.Conn
+	stop func() bool
+}
+
+// NetConn returns the underlying conn, as *tls.Conn does
+func (c *boundConn) NetConn() net.Conn { return c.Conn }
+
+func (c *boundConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
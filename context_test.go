@@ -0,0 +1,93 @@
+package connutil
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamPipe_ReadContext(t *testing.T) {
+	t.Run("cancel blocked read", func(t *testing.T) {
+		a, b := AsyncPipe()
+		defer a.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			_, err := a.ReadContext(ctx, make([]byte, 1))
+			done <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("expecting %v, got %v", context.Canceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("ReadContext did not return after cancellation")
+		}
+
+		// deadlines and later reads are unaffected
+		_, _ = b.Write([]byte{1})
+		n, err := a.Read(make([]byte, 1))
+		if n != 1 || err != nil {
+			t.Errorf("expecting 1 byte and no error, got %v and %v", n, err)
+		}
+	})
+
+	t.Run("context deadline", func(t *testing.T) {
+		a, _ := AsyncPipe()
+		defer a.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := a.ReadContext(ctx, make([]byte, 1))
+		if err != context.DeadlineExceeded {
+			t.Errorf("expecting %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		a, _ := LimitedAsyncPipe(1)
+		defer a.Close()
+		_, _ = a.Write([]byte{1, 2})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := a.WriteContext(ctx, []byte{3})
+		if err != context.DeadlineExceeded {
+			t.Errorf("expecting %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+}
+
+func TestPacketPipe_ReadContext(t *testing.T) {
+	a, b := AsyncPacketPipe()
+	defer a.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := a.ReadContext(ctx, make([]byte, 1))
+	if err != context.Canceled {
+		t.Errorf("expecting %v, got %v", context.Canceled, err)
+	}
+
+	_, _ = b.WriteContext(context.Background(), []byte("hi"))
+	buf := make([]byte, 2)
+	n, err := a.ReadContext(context.Background(), buf)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(buf[:n]) != "hi" {
+		t.Errorf("expecting %v, got %v", "hi", string(buf[:n]))
+	}
+}
+
+func TestBindContext(t *testing.T) {
+	a, _ := AsyncPipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := BindContext(a, ctx)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := conn.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+	}
+}
@@ -3,6 +3,7 @@ package connutil
 import (
 	"context"
 	"net"
+	"sync"
 	"sync/atomic"
 )
 
@@ -16,8 +17,10 @@ type Dialer interface {
 // PipeDialer implements the Dialer interface, which means it has the same method signatures as net.Dialer
 type PipeDialer struct {
 	// PipeBufferSize specifies the limit on the underlying buffer size. Default (0) means unlimited.
+	// It is overridden by WithBufferSizeLimit given to DialerListener, which can also limit each direction separately.
 	BufferSizeLimit int
 	peer            *PipeListener
+	opts            []PipeOption
 }
 
 // Dial returns one end of the pipe.
@@ -35,32 +38,123 @@ func (d *PipeDialer) DialContext(ctx context.Context, network, address string) (
 	if atomic.LoadUint32(&d.peer.closed) == 1 {
 		return nil, ErrListenerClosed
 	}
+	if err := d.peer.controller.waitDial(ctx); err != nil {
+		return nil, err
+	}
 
 	switch network {
 	case "udp", "udp4", "udp6", "ip", "ip4", "ip6", "unix", "unixgram", "unixpacket":
-		a, b := LimitedAsyncPacketPipe(d.BufferSizeLimit)
+		a, b := LimitedAsyncPacketPipe(d.BufferSizeLimit, d.opts...)
 		select {
 		case <-ctx.Done():
+			// never handed out, so nobody else will close it
+			a.Close()
+			b.Close()
 			return nil, ctx.Err()
+		case <-d.peer.done:
+			a.Close()
+			b.Close()
+			return nil, ErrListenerClosed
 		case d.peer.incomingPacketConn <- b:
+			d.peer.register(a, b)
+			d.peer.hooks.fire(HookEvent{Op: HookDial, Conn: a.ID()})
 			return a, nil
 		}
 	default:
-		a, b := LimitedAsyncPipe(d.BufferSizeLimit)
+		a, b := LimitedAsyncPipe(d.BufferSizeLimit, d.opts...)
 		select {
 		case <-ctx.Done():
+			// never handed out, so nobody else will close it
+			a.Close()
+			b.Close()
 			return nil, ctx.Err()
+		case <-d.peer.done:
+			a.Close()
+			b.Close()
+			return nil, ErrListenerClosed
 		case d.peer.incomingStreamConn <- b:
+			d.peer.register(a, b)
+			d.peer.hooks.fire(HookEvent{Op: HookDial, Conn: a.ID()})
 			return a, nil
 		}
 	}
 }
 
+// Stats returns the traffic statistics aggregated over the dialer's end of every pipe dialed so far, including the
+// closed ones. The statistics of a pipe are taken for the last time once it is closed, after which the pipe is no
+// longer referenced by the dialer.
+func (d *PipeDialer) Stats() Stats {
+	d.peer.connsM.Lock()
+	defer d.peer.connsM.Unlock()
+	d.peer.prune()
+	return d.peer.closedDialed.add(sumStats(d.peer.dialed))
+}
+
 // PipeListener is a net.Listener that accepts connections dialed from the corresponding PipeDialer
 type PipeListener struct {
 	incomingStreamConn chan net.Conn
 	incomingPacketConn chan net.PacketConn
 	closed             uint32
+	closeOnce          sync.Once
+	done               chan struct{}
+
+	hooks *Hooks
+	addr  net.Addr
+
+	connsM sync.Mutex
+	// dialed and accepted are the two ends of every pipe successfully dialed and not yet closed, in the same order
+	dialed   []pipeEnd
+	accepted []pipeEnd
+	// closedDialed and closedAccepted are the statistics of the closed pipes, which are no longer referenced
+	closedDialed   Stats
+	closedAccepted Stats
+
+	controller *PartitionController
+}
+
+func (l *PipeListener) register(dialed, accepted pipeEnd) {
+	l.connsM.Lock()
+	defer l.connsM.Unlock()
+	// the network may have been partitioned since the dial started
+	l.controller.apply(dialed)
+	l.prune()
+	l.dialed = append(l.dialed, dialed)
+	l.accepted = append(l.accepted, accepted)
+}
+
+// prune must be called with l.connsM held. It adds the statistics of the closed pipes to the running totals, and
+// drops them, so that a long-running dialer doesn't keep every pipe ever dialed.
+func (l *PipeListener) prune() {
+	n := 0
+	for i, dialed := range l.dialed {
+		if dialed.finished() {
+			l.closedDialed = l.closedDialed.add(dialed.Stats())
+			l.closedAccepted = l.closedAccepted.add(l.accepted[i].Stats())
+			continue
+		}
+		l.dialed[n], l.accepted[n] = dialed, l.accepted[i]
+		n++
+	}
+	for i := n; i < len(l.dialed); i++ {
+		l.dialed[i], l.accepted[i] = nil, nil
+	}
+	l.dialed, l.accepted = l.dialed[:n], l.accepted[:n]
+}
+
+func sumStats(conns []pipeEnd) (stats Stats) {
+	for _, conn := range conns {
+		stats = stats.add(conn.Stats())
+	}
+	return
+}
+
+// Stats returns the traffic statistics aggregated over the listener's end of every pipe dialed so far,
+// including the closed ones, in the same way as PipeDialer.Stats.
+func (l *PipeListener) Stats() Stats {
+	l.connsM.Lock()
+	defer l.connsM.Unlock()
+	l.prune()
+	return l.closedAccepted.add(sumStats(l.accepted))
 }
 
 // Accept implements Listener.Accept(). It returns one end of a StreamPipe, with the other end obtained through the
@@ -68,20 +162,29 @@ type PipeListener struct {
 func (l *PipeListener) Accept() (net.Conn, error) {
 	if atomic.LoadUint32(&l.closed) == 1 {
 		return nil, ErrListenerClosed
-	} else {
-		return <-l.incomingStreamConn, nil
+	}
+	select {
+	case conn := <-l.incomingStreamConn:
+		l.hooks.fire(HookEvent{Op: HookAccept, Conn: conn.(*StreamPipe).ID()})
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
 	}
 }
 
-// Close implements Listener.Close()
+// Close implements Listener.Close(). Pending Accept and ListenPacket calls will be unblocked.
 func (l *PipeListener) Close() error {
-	atomic.StoreUint32(&l.closed, 1)
+	l.closeOnce.Do(func() {
+		atomic.StoreUint32(&l.closed, 1)
+		close(l.done)
+	})
 	return nil
 }
 
-// Addr returns a fake address
+// Addr returns the address of the listener's end of the pipes, set through BtoA(WithAddr(addr)) on DialerListener, or
+// a fake address if there isn't one.
 func (l *PipeListener) Addr() net.Addr {
-	return fakeAddr{}
+	return l.addr
 }
 
 // ListenPacket has the same function signature as net.ListenPacket function, meaning it's a drop-in replacement.
@@ -92,8 +195,13 @@ func (l *PipeListener) Addr() net.Addr {
 func (l *PipeListener) ListenPacket(network, address string) (net.PacketConn, error) {
 	if atomic.LoadUint32(&l.closed) == 1 {
 		return nil, ErrListenerClosed
-	} else {
-		return <-l.incomingPacketConn, nil
+	}
+	select {
+	case conn := <-l.incomingPacketConn:
+		l.hooks.fire(HookEvent{Op: HookAccept, Conn: conn.(*PacketPipe).ID()})
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
 	}
 }
 
@@ -106,12 +214,21 @@ func (l *PipeListener) ListenPacket(network, address string) (net.PacketConn, er
 //
 // backlog specifies the amount of Dial calls you can make without making corresponding Accept or ListenPacket calls on
 // listener before Dial calls start blocking.
-func DialerListener(backlog int) (*PipeDialer, *PipeListener) {
+//
+// opts are applied to every pipe dialed. In terms of AtoB and BtoA, A is the end returned by PipeDialer.Dial, and B is
+// the end returned by PipeListener.Accept or PipeListener.ListenPacket. So AtoB configures the direction from the
+// client to the server, and BtoA the direction from the server to the client.
+func DialerListener(backlog int, opts ...PipeOption) (*PipeDialer, *PipeListener) {
+	config := newPipeConfig(opts)
 	l := &PipeListener{
+		hooks:              config.hooks,
+		addr:               config.dirs[dirBtoA].localAddr(),
 		incomingStreamConn: make(chan net.Conn, backlog),
 		incomingPacketConn: make(chan net.PacketConn, backlog),
 		closed:             0,
+		done:               make(chan struct{}),
 	}
-	d := &PipeDialer{peer: l}
+	l.controller = &PartitionController{l: l}
+	d := &PipeDialer{peer: l, opts: opts}
 	return d, l
 }
@@ -3,6 +3,7 @@ package connutil
 import (
 	"context"
 	"io"
+	"net"
 	"testing"
 	"time"
 )
@@ -109,3 +110,51 @@ func TestListener_Addr(t *testing.T) {
 		t.Error("listener's address shouldn't be nil")
 	}
 }
+
+func TestListener_CloseUnblocksAccept(t *testing.T) {
+	_, l := DialerListener(1)
+	done := make(chan error)
+	go func() {
+		_, err := l.Accept()
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_ = l.Close()
+	select {
+	case err := <-done:
+		if err != ErrListenerClosed {
+			t.Errorf("expecting %v, got %v", ErrListenerClosed, err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("Accept did not unblock after the listener is closed")
+	}
+}
+
+func TestDialerListener_Directions(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	server := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+	d, l := DialerListener(1, WithStrictLimit(),
+		AtoB(WithAddr(client), WithBufferSizeLimit(1024)),
+		BtoA(WithAddr(server)))
+	if l.Addr() != server {
+		t.Errorf("expecting %v, got %v", server, l.Addr())
+	}
+	a, err := d.Dial("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.LocalAddr() != client || b.RemoteAddr() != client {
+		t.Errorf("expecting %v, got %v and %v", client, a.LocalAddr(), b.RemoteAddr())
+	}
+	if n, err := b.Write(make([]byte, 8192)); err != nil || n != 8192 {
+		t.Errorf("expecting 8192 bytes and no error, got %v and %v", n, err)
+	}
+	_ = a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _ := a.Write(make([]byte, 8192)); n != 1024 {
+		t.Errorf("expecting %v, got %v", 1024, n)
+	}
+}
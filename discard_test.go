@@ -119,3 +119,23 @@ func TestDiscardConn_Addrs(t *testing.T) {
 		t.Error("RemoteAddr shouldn't return null pointer")
 	}
 }
+
+func TestDiscardConn_DeadlineWakeUp(t *testing.T) {
+	discard := Discard()
+	_ = discard.SetReadDeadline(time.Now().Add(time.Hour))
+	done := make(chan error)
+	go func() {
+		_, err := discard.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = discard.SetReadDeadline(time.Now().Add(-time.Second))
+	select {
+	case err := <-done:
+		if err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Read did not unblock after the deadline is brought forward")
+	}
+}
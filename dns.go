@@ -0,0 +1,363 @@
+package connutil
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeTXT   = 16
+	dnsTypeAAAA  = 28
+	dnsTypeSRV   = 33
+
+	dnsClassINET = 1
+
+	dnsRCodeSuccess    = 0
+	dnsRCodeServerFail = 2
+	dnsRCodeNameError  = 3
+	dnsRCodeNotImpl    = 4
+
+	// Responses larger than this are truncated over UDP, so that the client retries over TCP
+	dnsMaxUDPSize = 512
+	dnsTTL        = 60
+)
+
+var errBadDNSMessage = errors.New("malformed DNS message")
+
+type dnsRecord struct {
+	rrType uint16
+	rdata  []byte
+	// cname is the target of a CNAME record
+	cname string
+}
+
+// DNSServer is a minimal in-memory authoritative DNS server, serving over the pipes of a private
+// PipeDialer/PipeListener pair. Obtain a *net.Resolver querying it through func Resolver.
+//
+// It answers A, AAAA, CNAME, SRV and TXT queries for the records added to it, following CNAME chains. Queries for names
+// without any record are answered with NXDOMAIN. Names can also be made to fail with NXDOMAIN or SERVFAIL regardless of
+// their records.
+//
+// All methods are safe for concurrent use. Records can be changed while the server is running.
+type DNSServer struct {
+	mu       sync.RWMutex
+	records  map[string][]dnsRecord
+	failures map[string]int
+
+	dialer   *PipeDialer
+	listener *PipeListener
+}
+
+// NewDNSServer creates a DNSServer with no records and starts serving.
+func NewDNSServer() *DNSServer {
+	d, l := DialerListener(0)
+	s := &DNSServer{
+		records:  make(map[string][]dnsRecord),
+		failures: make(map[string]int),
+		dialer:   d,
+		listener: l,
+	}
+	go s.serveStreams()
+	go s.servePackets()
+	return s
+}
+
+// Resolver returns a *net.Resolver that sends all of its queries to s, regardless of the system's DNS configuration.
+//
+// Note that lookups through the resolver may still consult the hosts file first, depending on the system
+// configuration.
+func (s *DNSServer) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return s.dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// Close stops the server. Resolvers obtained from s will fail afterwards.
+func (s *DNSServer) Close() error {
+	return s.listener.Close()
+}
+
+func canonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+func (s *DNSServer) add(name string, records ...dnsRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = canonicalName(name)
+	s.records[name] = append(s.records[name], records...)
+}
+
+// AddA adds A records for name. It panics if any of ips isn't an IPv4 address.
+func (s *DNSServer) AddA(name string, ips ...net.IP) {
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			panic(fmt.Sprintf("connutil: %v is not an IPv4 address for an A record", ip))
+		}
+		s.add(name, dnsRecord{rrType: dnsTypeA, rdata: ip.To4()})
+	}
+}
+
+// AddAAAA adds AAAA records for name. It panics if any of ips isn't a valid IP address. IPv4 addresses are added in
+// their IPv4-mapped IPv6 form.
+func (s *DNSServer) AddAAAA(name string, ips ...net.IP) {
+	for _, ip := range ips {
+		if ip.To16() == nil {
+			panic(fmt.Sprintf("connutil: %v is not an IP address for an AAAA record", ip))
+		}
+		s.add(name, dnsRecord{rrType: dnsTypeAAAA, rdata: ip.To16()})
+	}
+}
+
+// AddCNAME makes name an alias of target. Queries for any other record type of name are answered with the
+// records of target.
+func (s *DNSServer) AddCNAME(name, target string) {
+	target = canonicalName(target)
+	s.add(name, dnsRecord{rrType: dnsTypeCNAME, rdata: appendDNSName(nil, target), cname: target})
+}
+
+// AddSRV adds SRV records for name. To serve net.Resolver.LookupSRV("xmpp", "tcp", "example.com"), name should be
+// "_xmpp._tcp.example.com".
+func (s *DNSServer) AddSRV(name string, srvs ...*net.SRV) {
+	for _, srv := range srvs {
+		rdata := binary.BigEndian.AppendUint16(nil, srv.Priority)
+		rdata = binary.BigEndian.AppendUint16(rdata, srv.Weight)
+		rdata = binary.BigEndian.AppendUint16(rdata, srv.Port)
+		rdata = appendDNSName(rdata, canonicalName(srv.Target))
+		s.add(name, dnsRecord{rrType: dnsTypeSRV, rdata: rdata})
+	}
+}
+
+// AddTXT adds a TXT record for name for each of txts. Strings longer than 255 bytes are split into multiple
+// character-strings of the same record.
+func (s *DNSServer) AddTXT(name string, txts ...string) {
+	for _, txt := range txts {
+		var rdata []byte
+		for {
+			chunk := txt
+			if len(chunk) > 255 {
+				chunk = chunk[:255]
+			}
+			rdata = append(append(rdata, byte(len(chunk))), chunk...)
+			txt = txt[len(chunk):]
+			if len(txt) == 0 {
+				break
+			}
+		}
+		s.add(name, dnsRecord{rrType: dnsTypeTXT, rdata: rdata})
+	}
+}
+
+// Remove deletes all records of name, and any failure injected for it
+func (s *DNSServer) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = canonicalName(name)
+	delete(s.records, name)
+	delete(s.failures, name)
+}
+
+// SetNXDOMAIN makes all queries for name fail with NXDOMAIN, even if it has records
+func (s *DNSServer) SetNXDOMAIN(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[canonicalName(name)] = dnsRCodeNameError
+}
+
+// SetSERVFAIL makes all queries for name fail with SERVFAIL
+func (s *DNSServer) SetSERVFAIL(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[canonicalName(name)] = dnsRCodeServerFail
+}
+
+// answer looks up the answer records to a question. The returned records are already encoded.
+func (s *DNSServer) answer(qName string, qType uint16) (rcode int, answers []byte, count int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := canonicalName(qName)
+	// bound the length of the CNAME chain, in case of loops
+	for hops := 0; hops < 8; hops++ {
+		if rcode, ok := s.failures[name]; ok {
+			return rcode, answers, count
+		}
+		records, ok := s.records[name]
+		if !ok {
+			if count == 0 {
+				return dnsRCodeNameError, nil, 0
+			}
+			return dnsRCodeSuccess, answers, count
+		}
+
+		var next string
+		for _, r := range records {
+			if r.rrType == qType {
+				answers = appendDNSRecord(answers, name, r)
+				count++
+			} else if r.rrType == dnsTypeCNAME && next == "" {
+				answers = appendDNSRecord(answers, name, r)
+				count++
+				next = r.cname
+			}
+		}
+		if next == "" || qType == dnsTypeCNAME {
+			break
+		}
+		name = next
+	}
+	return dnsRCodeSuccess, answers, count
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(append(b, byte(len(label))), label...)
+	}
+	return append(b, 0)
+}
+
+func appendDNSRecord(b []byte, name string, r dnsRecord) []byte {
+	b = appendDNSName(b, name)
+	b = binary.BigEndian.AppendUint16(b, r.rrType)
+	b = binary.BigEndian.AppendUint16(b, dnsClassINET)
+	b = binary.BigEndian.AppendUint32(b, dnsTTL)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.rdata)))
+	return append(b, r.rdata...)
+}
+
+// parseDNSQuestion parses the first question of a query. It returns the queried name and type, and the offset of
+// the end of the question.
+func parseDNSQuestion(query []byte) (name string, qType uint16, end int, err error) {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:6]) == 0 {
+		return "", 0, 0, errBadDNSMessage
+	}
+	var labels []string
+	i := 12
+	for {
+		if i >= len(query) {
+			return "", 0, 0, errBadDNSMessage
+		}
+		l := int(query[i])
+		i++
+		if l == 0 {
+			break
+		}
+		// compression pointers are never used by clients in questions
+		if l > 63 || i+l > len(query) {
+			return "", 0, 0, errBadDNSMessage
+		}
+		labels = append(labels, string(query[i:i+l]))
+		i += l
+	}
+	if i+4 > len(query) {
+		return "", 0, 0, errBadDNSMessage
+	}
+	qType = binary.BigEndian.Uint16(query[i:])
+	return strings.Join(labels, ".") + ".", qType, i + 4, nil
+}
+
+// respond builds the response to a query. It returns nil if the query cannot be understood at all.
+func (s *DNSServer) respond(query []byte, maxSize int) []byte {
+	name, qType, qEnd, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil
+	}
+
+	var rcode, count int
+	var answers []byte
+	switch qType {
+	case dnsTypeA, dnsTypeAAAA, dnsTypeCNAME, dnsTypeSRV, dnsTypeTXT:
+		rcode, answers, count = s.answer(name, qType)
+	default:
+		rcode = dnsRCodeNotImpl
+	}
+
+	// QR, AA and RA are set, RD is copied from the query
+	flags := uint16(0x8000|0x0400|0x0080) | binary.BigEndian.Uint16(query[2:4])&0x0100 | uint16(rcode)
+	resp := append([]byte(nil), query[:2]...)
+	resp = binary.BigEndian.AppendUint16(resp, flags)
+	resp = binary.BigEndian.AppendUint16(resp, 1)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(count))
+	resp = binary.BigEndian.AppendUint32(resp, 0)
+	resp = append(resp, query[12:qEnd]...)
+	if maxSize > 0 && len(resp)+len(answers) > maxSize {
+		// set TC and drop all answers
+		binary.BigEndian.PutUint16(resp[2:4], flags|0x0200)
+		binary.BigEndian.PutUint16(resp[6:8], 0)
+		return resp
+	}
+	return append(resp, answers...)
+}
+
+func (s *DNSServer) servePackets() {
+	for {
+		conn, err := s.listener.ListenPacket("udp", "")
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 65535)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				resp := s.respond(buf[:n], dnsMaxUDPSize)
+				if resp == nil {
+					continue
+				}
+				if _, err = conn.WriteTo(resp, addr); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) serveStreams() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			lenBuf := make([]byte, 2)
+			for {
+				if _, err := io.ReadFull(conn, lenBuf); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(lenBuf))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := s.respond(query, 0)
+				if resp == nil {
+					return
+				}
+				if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,119 @@
+package connutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDNSServer(t *testing.T) {
+	s := NewDNSServer()
+	defer s.Close()
+	s.AddA("host.connutil.test", net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"))
+	s.AddAAAA("host.connutil.test", net.ParseIP("2001:db8::1"))
+	s.AddCNAME("alias.connutil.test", "host.connutil.test")
+	s.AddSRV("_xmpp._tcp.connutil.test", &net.SRV{Target: "host.connutil.test", Port: 5222, Priority: 10, Weight: 5})
+	s.AddTXT("host.connutil.test", "v=spf1 -all", strings.Repeat("a", 300))
+	s.AddA("broken.connutil.test", net.ParseIP("192.0.2.3"))
+	s.SetSERVFAIL("broken.connutil.test")
+	s.AddA("gone.connutil.test", net.ParseIP("192.0.2.4"))
+	s.SetNXDOMAIN("gone.connutil.test")
+
+	r := s.Resolver()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("A and AAAA", func(t *testing.T) {
+		addrs, err := r.LookupHost(ctx, "host.connutil.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(addrs)
+		expected := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}
+		if strings.Join(addrs, ",") != strings.Join(expected, ",") {
+			t.Errorf("expecting %v, got %v", expected, addrs)
+		}
+	})
+	t.Run("CNAME", func(t *testing.T) {
+		cname, err := r.LookupCNAME(ctx, "alias.connutil.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cname != "host.connutil.test." {
+			t.Errorf("expecting host.connutil.test., got %v", cname)
+		}
+		ips, err := r.LookupIP(ctx, "ip4", "alias.connutil.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 2 {
+			t.Errorf("expecting 2 addresses through the alias, got %v", ips)
+		}
+	})
+	t.Run("SRV", func(t *testing.T) {
+		_, srvs, err := r.LookupSRV(ctx, "xmpp", "tcp", "connutil.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srvs) != 1 || srvs[0].Target != "host.connutil.test." || srvs[0].Port != 5222 {
+			t.Errorf("unexpected SRV records %v", srvs)
+		}
+	})
+	t.Run("TXT", func(t *testing.T) {
+		txts, err := r.LookupTXT(ctx, "host.connutil.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(txts)
+		if len(txts) != 2 || txts[0] != strings.Repeat("a", 300) || txts[1] != "v=spf1 -all" {
+			t.Errorf("unexpected TXT records %v", txts)
+		}
+	})
+	t.Run("NXDOMAIN", func(t *testing.T) {
+		for _, name := range []string{"gone.connutil.test", "nothing.connutil.test"} {
+			_, err := r.LookupHost(ctx, name)
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Errorf("expecting not found error for %v, got %v", name, err)
+			}
+		}
+	})
+	t.Run("SERVFAIL", func(t *testing.T) {
+		_, err := r.LookupHost(ctx, "broken.connutil.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+			t.Errorf("expecting temporary error, got %v", err)
+		}
+	})
+	t.Run("truncated response falls back to TCP", func(t *testing.T) {
+		for i := 0; i < 64; i++ {
+			s.AddA("many.connutil.test", net.IPv4(198, 51, 100, byte(i)))
+		}
+		ips, err := r.LookupIP(ctx, "ip4", "many.connutil.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 64 {
+			t.Errorf("expecting 64 addresses, got %v", len(ips))
+		}
+	})
+	t.Run("invalid addresses", func(t *testing.T) {
+		for _, add := range []func(){
+			func() { s.AddA("bad.connutil.test", net.ParseIP("2001:db8::1")) },
+			func() { s.AddAAAA("bad.connutil.test", net.IP{1, 2, 3}) },
+		} {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Error("expecting a panic")
+					}
+				}()
+				add()
+			}()
+		}
+	})
+}
@@ -1,20 +1,170 @@
 package connutil
 
 import (
+	"errors"
 	"io"
 	"net"
+	"sync"
+	"time"
 )
 
-func echo(conn net.Conn) {
-	_, err := io.Copy(conn, conn)
-	if err != nil {
-		conn.Close()
+// EchoOption configures the echoing done by Echoer, PacketEchoer and EchoServer
+type EchoOption func(*echoConfig)
+
+type echoConfig struct {
+	delay     time.Duration
+	transform func([]byte) []byte
+	// limit == 0 means no limit
+	limit   int64
+	onError func(net.Conn, error)
+	tracker *Tracker
+}
+
+// EchoDelay delays echoing each chunk of data read, or each datagram in packet mode, by d
+func EchoDelay(d time.Duration) EchoOption {
+	return func(config *echoConfig) {
+		config.delay = d
+	}
+}
+
+// EchoTransform makes the data echoed back go through transform first. transform is called with each chunk of data
+// read, or each datagram in packet mode, and its return value is written back. The slice given to transform is reused
+// afterwards, so transform must not retain it.
+func EchoTransform(transform func([]byte) []byte) EchoOption {
+	return func(config *echoConfig) {
+		config.transform = transform
+	}
+}
+
+// EchoLimit makes the echoing stop after n bytes have been echoed, after which the conn is closed. In packet mode,
+// the datagram crossing the limit is truncated.
+func EchoLimit(n int64) EchoOption {
+	return func(config *echoConfig) {
+		config.limit = n
+	}
+}
+
+// EchoOnError makes onError called with the conn and the error when echoing stops because of an error. Running out of
+// data to echo, i.e. io.EOF, and the conn being closed are not errors. onError is called before the conn is closed.
+func EchoOnError(onError func(conn net.Conn, err error)) EchoOption {
+	return func(config *echoConfig) {
+		config.onError = onError
 	}
 }
 
-// Echoer returns a net.Conn to which everything written will be echoed back
-func Echoer() net.Conn {
-	a, b := AsyncPipe()
-	go echo(b)
+// EchoTracker registers the goroutines echoing, and the pipes created by Echoer and PacketEchoer, with tr, so that
+// tr.Check reports the ones still running or never closed.
+func EchoTracker(tr *Tracker) EchoOption {
+	return func(config *echoConfig) {
+		config.tracker = tr
+	}
+}
+
+func newEchoConfig(opts []EchoOption) *echoConfig {
+	config := &echoConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+func echo(conn net.Conn, config *echoConfig, done chan struct{}) {
+	defer close(done)
+	defer conn.Close()
+	err := echoLoop(conn, config)
+	if err != nil && config.onError != nil &&
+		!errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, net.ErrClosed) {
+		config.onError(conn, err)
+	}
+}
+
+func echoLoop(conn net.Conn, config *echoConfig) error {
+	buf := make([]byte, 64*1024)
+	var echoed int64
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			if config.limit != 0 && int64(n) > config.limit-echoed {
+				chunk = chunk[:config.limit-echoed]
+			}
+			echoed += int64(len(chunk))
+			if config.delay > 0 {
+				time.Sleep(config.delay)
+			}
+			if config.transform != nil {
+				chunk = config.transform(chunk)
+			}
+			if _, err := conn.Write(chunk); err != nil {
+				return err
+			}
+			if config.limit != 0 && echoed >= config.limit {
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Echoer returns a net.Conn to which everything written will be echoed back. The conn is closed once the echoing
+// stops, either because of EchoLimit or because of an error, which is reported through EchoOnError.
+func Echoer(opts ...EchoOption) net.Conn {
+	config := newEchoConfig(opts)
+	a, b := AsyncPipe(WithTracker(config.tracker))
+	done := make(chan struct{})
+	trackGoroutine(config.tracker, "Echoer", done)
+	go echo(b, config, done)
 	return a
 }
+
+// PacketEchoer is similar to Echoer, but echoes over an AsyncPacketPipe, such that every datagram written is echoed
+// back as one datagram.
+func PacketEchoer(opts ...EchoOption) *PacketPipe {
+	config := newEchoConfig(opts)
+	a, b := AsyncPacketPipe(WithTracker(config.tracker))
+	done := make(chan struct{})
+	trackGoroutine(config.tracker, "PacketEchoer", done)
+	go echo(b, config, done)
+	return a
+}
+
+// EchoServer accepts conns from l, and echoes back everything read from each of them in its own goroutine, as Echoer
+// does. It blocks until l.Accept fails, such as after l is closed. It then closes the conns still being echoed, waits
+// for their goroutines to exit, and returns the error of l.Accept. Errors of individual conns are reported through
+// EchoOnError.
+func EchoServer(l net.Listener, opts ...EchoOption) error {
+	config := newEchoConfig(opts)
+	var wg sync.WaitGroup
+	var connsM sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	defer func() {
+		connsM.Lock()
+		for conn := range conns {
+			_ = conn.Close()
+		}
+		connsM.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		connsM.Lock()
+		conns[conn] = struct{}{}
+		connsM.Unlock()
+		done := make(chan struct{})
+		trackGoroutine(config.tracker, "EchoServer", done)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			echo(conn, config, done)
+			connsM.Lock()
+			delete(conns, conn)
+			connsM.Unlock()
+		}()
+	}
+}
@@ -1,9 +1,12 @@
 package connutil
 
 import (
+	"bytes"
 	"io"
 	"math/rand"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestEchoer(t *testing.T) {
@@ -25,3 +28,149 @@ func TestEchoer(t *testing.T) {
 		t.Errorf("expecting error %v, got %v", io.ErrClosedPipe, err)
 	}
 }
+
+func TestEchoer_Options(t *testing.T) {
+	t.Run("delay", func(t *testing.T) {
+		e := Echoer(EchoDelay(100 * time.Millisecond))
+		defer e.Close()
+		start := time.Now()
+		_, _ = e.Write([]byte("hi"))
+		_, _ = io.ReadFull(e, make([]byte, 2))
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("expecting at least 100ms, got %v", elapsed)
+		}
+	})
+
+	t.Run("transform", func(t *testing.T) {
+		e := Echoer(EchoTransform(bytes.ToUpper))
+		defer e.Close()
+		_, _ = e.Write([]byte("hello"))
+		recvBuf := make([]byte, 5)
+		_, _ = io.ReadFull(e, recvBuf)
+		if string(recvBuf) != "HELLO" {
+			t.Errorf("expecting %v, got %v", "HELLO", string(recvBuf))
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		e := Echoer(EchoLimit(3))
+		_, _ = e.Write([]byte("hello"))
+		recvBuf := make([]byte, 3)
+		_, err := io.ReadFull(e, recvBuf)
+		if err != nil && err != io.ErrClosedPipe {
+			t.Error(err)
+		}
+		_, err = e.Read(recvBuf)
+		if err != io.ErrClosedPipe {
+			t.Errorf("expecting error %v, got %v", io.ErrClosedPipe, err)
+		}
+	})
+}
+
+func TestEchoer_OnError(t *testing.T) {
+	t.Run("reset", func(t *testing.T) {
+		errs := make(chan error, 1)
+		e := Echoer(EchoOnError(func(conn net.Conn, err error) { errs <- err }))
+		_ = e.(*StreamPipe).SetLinger(0)
+		_ = e.Close()
+		select {
+		case err := <-errs:
+			if err != ErrConnReset {
+				t.Errorf("expecting %v, got %v", ErrConnReset, err)
+			}
+		case <-time.After(time.Second):
+			t.Error("error not reported")
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		errs := make(chan error, 1)
+		e := Echoer(EchoOnError(func(conn net.Conn, err error) { errs <- err }))
+		_ = e.Close()
+		select {
+		case err := <-errs:
+			t.Errorf("expecting no error, got %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestPacketEchoer(t *testing.T) {
+	e := PacketEchoer(EchoTransform(func(b []byte) []byte {
+		// framing
+		return append([]byte{byte(len(b))}, b...)
+	}))
+	defer e.Close()
+	_, _ = e.Write([]byte("ab"))
+	_, _ = e.Write([]byte("cde"))
+	for _, expected := range []string{"\x02ab", "\x03cde"} {
+		recvBuf := make([]byte, 16)
+		n, err := e.Read(recvBuf)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(recvBuf[:n]) != expected {
+			t.Errorf("expecting %q, got %q", expected, recvBuf[:n])
+		}
+	}
+}
+
+func TestEchoServer(t *testing.T) {
+	d, l := DialerListener(0)
+	done := make(chan error)
+	go func() {
+		done <- EchoServer(l)
+	}()
+
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial("tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write([]byte("ping"))
+		recvBuf := make([]byte, 4)
+		_, err = io.ReadFull(conn, recvBuf)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(recvBuf) != "ping" {
+			t.Errorf("expecting %v, got %v", "ping", string(recvBuf))
+		}
+		_ = conn.Close()
+	}
+
+	_ = l.Close()
+	select {
+	case err := <-done:
+		if err != ErrListenerClosed {
+			t.Errorf("expecting error %v, got %v", ErrListenerClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("EchoServer did not return after the listener is closed")
+	}
+}
+
+func TestEchoServer_Shutdown(t *testing.T) {
+	d, l := DialerListener(0)
+	done := make(chan error)
+	go func() {
+		done <- EchoServer(l)
+	}()
+	conn, err := d.Dial("tcp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("ping"))
+	_, _ = io.ReadFull(conn, make([]byte, 4))
+
+	// the conn still being echoed is closed by EchoServer
+	_ = l.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("EchoServer did not return after the listener is closed")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+	}
+}
@@ -1,9 +1,21 @@
 package connutil
 
-import "errors"
+import (
+	"errors"
+	"syscall"
+)
 
 var (
-	ErrTimeout        = errors.New("deadline exceeded")
-	ErrListenerClosed = errors.New("the listener is closed")
-	ErrWriteToLarge   = errors.New("write is too large for the buffer")
+	ErrTimeout          = errors.New("deadline exceeded")
+	ErrListenerClosed   = errors.New("the listener is closed")
+	ErrWriteToLarge     = errors.New("write is too large for the buffer")
+	ErrBadProxyHeader   = errors.New("malformed PROXY protocol header")
+	ErrMuxSessionClosed = errors.New("the mux session is closed")
+	// ErrConnReset is returned on a conn reset by its peer. It is syscall.ECONNRESET, the same error a reset TCP
+	// connection returns.
+	ErrConnReset error = syscall.ECONNRESET
+	// ErrConnRefused is returned by dials refused during a network partition. It is syscall.ECONNREFUSED.
+	ErrConnRefused error = syscall.ECONNREFUSED
+	// ErrConnTimedOut is returned on a conn whose peer has vanished, detected by keepalive. It is syscall.ETIMEDOUT.
+	ErrConnTimedOut error = syscall.ETIMEDOUT
 )
@@ -0,0 +1,163 @@
+package connutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+var pipeSeq uint64
+
+func nextPipeID() uint64 {
+	return atomic.AddUint64(&pipeSeq, 1)
+}
+
+// ConnID identifies one end of a pipe.
+type ConnID struct {
+	// Pipe is unique to each pipe created in this process
+	Pipe uint64
+	// End is 0 for the first end returned by the pipe constructors, or the end returned by PipeDialer.Dial, and 1 for
+	// the other end.
+	End int
+}
+
+func (id ConnID) String() string {
+	return fmt.Sprintf("pipe%d/%c", id.Pipe, 'a'+id.End)
+}
+
+func (id ConnID) peer() ConnID {
+	return ConnID{Pipe: id.Pipe, End: 1 - id.End}
+}
+
+// HookOp is the kind of operation that triggers a hook
+type HookOp string
+
+const (
+	HookWrite            HookOp = "write"
+	HookRead             HookOp = "read"
+	HookBlock            HookOp = "block"
+	HookUnblock          HookOp = "unblock"
+	HookSetReadDeadline  HookOp = "set_read_deadline"
+	HookSetWriteDeadline HookOp = "set_write_deadline"
+	HookReadTimeout      HookOp = "read_timeout"
+	HookWriteTimeout     HookOp = "write_timeout"
+	HookClose            HookOp = "close"
+	HookDial             HookOp = "dial"
+	HookAccept           HookOp = "accept"
+)
+
+// HookEvent describes an operation on one end of a pipe
+type HookEvent struct {
+	Op HookOp
+	// Conn is the end of the pipe on which the operation is performed
+	Conn ConnID
+	// N is the number of bytes read or written
+	N int
+	// Buffered is the number of bytes buffered in the direction concerned, after the operation
+	Buffered int
+	// Deadline is the deadline being set
+	Deadline time.Time
+	Err      error
+}
+
+// Hooks holds callbacks invoked on operations on pipes. Any of the callbacks can be nil.
+//
+// Callbacks are called synchronously from the goroutine performing the operation, after the operation is done (or,
+// for Block, before the goroutine starts waiting). Internal locks are not held while calling them.
+type Hooks struct {
+	// Write is called after every Write call, including failed ones
+	Write func(HookEvent)
+	// Read is called after every Read call, including failed ones
+	Read func(HookEvent)
+	// Block is called when a Write call starts waiting for the other end to read because of the buffer size limit
+	Block func(HookEvent)
+	// Unblock is called when a Write call that has blocked resumes
+	Unblock func(HookEvent)
+	// SetDeadline is called when a read or write deadline is set. Op distinguishes between the two.
+	SetDeadline func(HookEvent)
+	// Timeout is called when a Read or Write fails because its deadline is exceeded. Op distinguishes between the two.
+	Timeout func(HookEvent)
+	// Close is called when either end of the pipe is closed
+	Close func(HookEvent)
+	// Dial is called with the dialer's end of a pipe successfully dialed through PipeDialer
+	Dial func(HookEvent)
+	// Accept is called with the listener's end of a pipe returned by PipeListener's Accept or ListenPacket
+	Accept func(HookEvent)
+}
+
+func (h *Hooks) fire(ev HookEvent) {
+	if h == nil {
+		return
+	}
+	var f func(HookEvent)
+	switch ev.Op {
+	case HookWrite:
+		f = h.Write
+	case HookRead:
+		f = h.Read
+	case HookBlock:
+		f = h.Block
+	case HookUnblock:
+		f = h.Unblock
+	case HookSetReadDeadline, HookSetWriteDeadline:
+		f = h.SetDeadline
+	case HookReadTimeout, HookWriteTimeout:
+		f = h.Timeout
+	case HookClose:
+		f = h.Close
+	case HookDial:
+		f = h.Dial
+	case HookAccept:
+		f = h.Accept
+	}
+	if f != nil {
+		f(ev)
+	}
+}
+
+// SlogHooks returns Hooks that log every event to logger at the given level, giving a structured trace of all
+// operations on the pipes.
+func SlogHooks(logger *slog.Logger, level slog.Level) *Hooks {
+	log := func(ev HookEvent) {
+		attrs := []slog.Attr{
+			slog.String("conn", ev.Conn.String()),
+			slog.Int("n", ev.N),
+			slog.Int("buffered", ev.Buffered),
+		}
+		if !ev.Deadline.IsZero() {
+			attrs = append(attrs, slog.Time("deadline", ev.Deadline))
+		}
+		if ev.Err != nil {
+			attrs = append(attrs, slog.String("err", ev.Err.Error()))
+		}
+		logger.LogAttrs(context.Background(), level, string(ev.Op), attrs...)
+	}
+	return &Hooks{
+		Write:       log,
+		Read:        log,
+		Block:       log,
+		Unblock:     log,
+		SetDeadline: log,
+		Timeout:     log,
+		Close:       log,
+		Dial:        log,
+		Accept:      log,
+	}
+}
+
+// fireIO fires the hooks of a Read or Write call, and the Timeout hook if it has timed out
+func (h *Hooks) fireIO(op HookOp, conn ConnID, n int, buffered int, err error) {
+	if h == nil {
+		return
+	}
+	if err == ErrTimeout {
+		timeoutOp := HookReadTimeout
+		if op == HookWrite {
+			timeoutOp = HookWriteTimeout
+		}
+		h.fire(HookEvent{Op: timeoutOp, Conn: conn, Buffered: buffered, Err: err})
+	}
+	h.fire(HookEvent{Op: op, Conn: conn, N: n, Buffered: buffered, Err: err})
+}
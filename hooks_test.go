@@ -0,0 +1,120 @@
+package connutil
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type hookRecorder struct {
+	mu     sync.Mutex
+	events []HookEvent
+}
+
+func (r *hookRecorder) record(ev HookEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *hookRecorder) ops() []HookOp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ops []HookOp
+	for _, ev := range r.events {
+		ops = append(ops, ev.Op)
+	}
+	return ops
+}
+
+func (r *hookRecorder) hooks() *Hooks {
+	return &Hooks{
+		Write:       r.record,
+		Read:        r.record,
+		Block:       r.record,
+		Unblock:     r.record,
+		SetDeadline: r.record,
+		Timeout:     r.record,
+		Close:       r.record,
+		Dial:        r.record,
+		Accept:      r.record,
+	}
+}
+
+func TestHooks_StreamPipe(t *testing.T) {
+	rec := &hookRecorder{}
+	a, b := LimitedAsyncPipe(1, WithHooks(rec.hooks()))
+	_, _ = a.Write(make([]byte, 2))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = b.Read(make([]byte, 2))
+	}()
+	// blocks until b reads
+	_, _ = a.Write(make([]byte, 3))
+	_ = b.SetReadDeadline(time.Now().Add(-1 * time.Second))
+	_, _ = b.Read(make([]byte, 3))
+	_ = a.Close()
+
+	expected := []HookOp{HookWrite, HookBlock, HookRead, HookUnblock, HookWrite, HookSetReadDeadline, HookReadTimeout, HookRead, HookClose}
+	ops := rec.ops()
+	if len(ops) == len(expected) && ops[2] == HookUnblock {
+		// the reading goroutine and the unblocked writer race to fire their hooks
+		ops[2], ops[3] = ops[3], ops[2]
+	}
+	if strings.Join(opStrings(ops), ",") != strings.Join(opStrings(expected), ",") {
+		t.Fatalf("expecting events %v, got %v", expected, ops)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.events[0].Conn != a.ID() || rec.events[0].N != 2 {
+		t.Errorf("unexpected write event %+v", rec.events[0])
+	}
+	if rec.events[7].Conn != b.ID() || rec.events[7].Err != ErrTimeout {
+		t.Errorf("unexpected read event %+v", rec.events[7])
+	}
+	if rec.events[4].Buffered != 3 {
+		t.Errorf("expecting 3 bytes buffered after the second write, got %v", rec.events[4].Buffered)
+	}
+}
+
+func opStrings(ops []HookOp) []string {
+	var strs []string
+	for _, op := range ops {
+		strs = append(strs, string(op))
+	}
+	return strs
+}
+
+func TestHooks_DialerListener(t *testing.T) {
+	rec := &hookRecorder{}
+	d, l := DialerListener(1, WithHooks(rec.hooks()))
+	a, _ := d.Dial("udp", "")
+	b, _ := l.ListenPacket("udp", "")
+	_, _ = a.Write(make([]byte, 16))
+	_, _, _ = b.ReadFrom(make([]byte, 16))
+
+	expected := []HookOp{HookDial, HookAccept, HookWrite, HookRead}
+	if ops := rec.ops(); strings.Join(opStrings(ops), ",") != strings.Join(opStrings(expected), ",") {
+		t.Errorf("expecting events %v, got %v", expected, ops)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.events[0].Conn.peer() != rec.events[1].Conn {
+		t.Errorf("dialed and accepted conns should be two ends of the same pipe, got %v and %v", rec.events[0].Conn, rec.events[1].Conn)
+	}
+}
+
+func TestSlogHooks(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	a, _ := AsyncPacketPipe(WithHooks(SlogHooks(logger, slog.LevelInfo)))
+	_, _ = a.Write(make([]byte, 16))
+
+	if !strings.Contains(buf.String(), "msg=write conn="+a.ID().String()+" n=16") {
+		t.Errorf("unexpected log output %q", buf.String())
+	}
+}
@@ -0,0 +1,155 @@
+package connutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Direction is the direction of the traffic seen by an Interceptor
+type Direction int
+
+const (
+	// ClientToServer is the traffic from the dialer to the listener
+	ClientToServer Direction = iota
+	// ServerToClient is the traffic from the listener to the dialer
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+// Chunk is a piece of traffic seen by an Interceptor: the data returned by one Read call on a stream pipe, or one
+// datagram on a packet pipe.
+type Chunk struct {
+	// Conn is the connection the chunk belongs to
+	Conn *InterceptedConn
+	// Direction is the direction the chunk is travelling in
+	Direction Direction
+	// Seq is the index of the chunk among all chunks in the same direction of the same connection, starting from 0
+	Seq int
+	// Data is owned by the Interceptor, and can be modified or retained
+	Data []byte
+}
+
+// Interceptor is called with every chunk of traffic between the client and the server. It returns the data to
+// forward in place of the chunk: return chunk.Data to pass it through, modified data to modify it, or nothing to drop
+// it. Returning multiple slices injects data, which are forwarded as separate datagrams on packet pipes.
+//
+// Interceptor may block to delay a chunk, which holds back all chunks after it in the same direction of the same
+// connection. Use InterceptedConn.Inject to send data at any other time.
+//
+// Interceptor is called concurrently for different directions and connections.
+type Interceptor func(chunk Chunk) [][]byte
+
+// InterceptedConn is a connection between a client and a server intercepted by an InterceptDialer
+type InterceptedConn struct {
+	// ID is the identity of the conn returned to the client by Dial
+	ID ConnID
+
+	// client and server are the ends the interceptor reads from and writes to
+	client net.Conn
+	server net.Conn
+	// toClientM and toServerM serialize writes in each direction
+	toClientM sync.Mutex
+	toServerM sync.Mutex
+}
+
+// Inject sends data in the direction given, as if it came from the client or the server. It is sent as a single
+// datagram on packet pipes.
+func (c *InterceptedConn) Inject(dir Direction, data []byte) error {
+	if dir == ClientToServer {
+		c.toServerM.Lock()
+		defer c.toServerM.Unlock()
+		_, err := c.server.Write(data)
+		return err
+	}
+	c.toClientM.Lock()
+	defer c.toClientM.Unlock()
+	_, err := c.client.Write(data)
+	return err
+}
+
+// InterceptDialer is a Dialer whose connections to a PipeListener are intercepted. It is created by Intercept.
+type InterceptDialer struct {
+	dialer    *PipeDialer
+	intercept Interceptor
+}
+
+// Intercept returns a Dialer that dials through d, with an Interceptor sitting between the client and the server in
+// the middle of every connection.
+//
+// Closing, half-closing and resetting are passed through as they are.
+func Intercept(d *PipeDialer, intercept Interceptor) *InterceptDialer {
+	return &InterceptDialer{dialer: d, intercept: intercept}
+}
+
+// Dial behaves like PipeDialer.Dial, but the connection is intercepted
+func (d *InterceptDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext behaves like PipeDialer.DialContext, but the connection is intercepted
+func (d *InterceptDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	server, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var client, mitm net.Conn
+	var id ConnID
+	switch server.(type) {
+	case *PacketPipe:
+		a, b := LimitedAsyncPacketPipe(d.dialer.BufferSizeLimit, d.dialer.opts...)
+		client, mitm, id = a, b, a.ID()
+	default:
+		a, b := LimitedAsyncPipe(d.dialer.BufferSizeLimit, d.dialer.opts...)
+		client, mitm, id = a, b, a.ID()
+	}
+	c := &InterceptedConn{ID: id, client: mitm, server: server}
+	go d.forward(c, ClientToServer)
+	go d.forward(c, ServerToClient)
+	return client, nil
+}
+
+func (d *InterceptDialer) forward(c *InterceptedConn, dir Direction) {
+	src, dst, dstM := c.client, c.server, &c.toServerM
+	if dir == ServerToClient {
+		src, dst, dstM = c.server, c.client, &c.toClientM
+	}
+
+	buf := make([]byte, 64*1024)
+	for seq := 0; ; seq++ {
+		n, err := src.Read(buf)
+		if n > 0 {
+			chunk := Chunk{Conn: c, Direction: dir, Seq: seq, Data: append([]byte(nil), buf[:n]...)}
+			for _, data := range d.intercept(chunk) {
+				dstM.Lock()
+				_, wErr := dst.Write(data)
+				dstM.Unlock()
+				if wErr != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			switch {
+			case err == io.EOF:
+				if cw, ok := dst.(closeWriter); ok {
+					_ = cw.CloseWrite()
+				}
+			case errors.Is(err, ErrConnReset):
+				reset(dst)
+			default:
+				_ = dst.Close()
+			}
+			return
+		}
+	}
+}
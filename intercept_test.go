@@ -0,0 +1,142 @@
+package connutil
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIntercept(t *testing.T) {
+	t.Run("modify and tag", func(t *testing.T) {
+		d, l := DialerListener(1)
+		var chunksM sync.Mutex
+		var chunks []Chunk
+		dialer := Intercept(d, func(chunk Chunk) [][]byte {
+			chunksM.Lock()
+			chunks = append(chunks, chunk)
+			chunksM.Unlock()
+			if chunk.Direction == ClientToServer {
+				return [][]byte{bytes.ToUpper(chunk.Data)}
+			}
+			return [][]byte{chunk.Data}
+		})
+		client, err := dialer.Dial("tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, _ := l.Accept()
+
+		_, _ = client.Write([]byte("hello"))
+		received := make([]byte, 5)
+		_, _ = io.ReadFull(server, received)
+		if string(received) != "HELLO" {
+			t.Errorf("expecting %v, got %v", "HELLO", string(received))
+		}
+		_, _ = server.Write([]byte("world"))
+		_, _ = io.ReadFull(client, received)
+		if string(received) != "world" {
+			t.Errorf("expecting %v, got %v", "world", string(received))
+		}
+
+		chunksM.Lock()
+		defer chunksM.Unlock()
+		if len(chunks) != 2 {
+			t.Fatalf("expecting %v chunks, got %v", 2, len(chunks))
+		}
+		if chunks[0].Direction != ClientToServer || chunks[1].Direction != ServerToClient {
+			t.Errorf("unexpected directions %v and %v", chunks[0].Direction, chunks[1].Direction)
+		}
+		if chunks[0].Conn.ID != client.(*StreamPipe).ID() {
+			t.Errorf("expecting %v, got %v", client.(*StreamPipe).ID(), chunks[0].Conn.ID)
+		}
+		_ = client.Close()
+	})
+
+	t.Run("drop, delay and replay", func(t *testing.T) {
+		d, l := DialerListener(1)
+		dialer := Intercept(d, func(chunk Chunk) [][]byte {
+			switch {
+			case chunk.Direction == ServerToClient:
+				// drop
+				return nil
+			case chunk.Seq == 0:
+				time.Sleep(50 * time.Millisecond)
+				// replay the first client flight
+				return [][]byte{chunk.Data, chunk.Data}
+			}
+			return [][]byte{chunk.Data}
+		})
+		client, _ := dialer.Dial("tcp", "")
+		server, _ := l.Accept()
+
+		start := time.Now()
+		_, _ = client.Write([]byte("hi"))
+		received := make([]byte, 4)
+		_, _ = io.ReadFull(server, received)
+		if string(received) != "hihi" {
+			t.Errorf("expecting %v, got %v", "hihi", string(received))
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("expecting at least 50ms, got %v", elapsed)
+		}
+
+		_, _ = server.Write([]byte("dropped"))
+		_ = client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := client.Read(received); err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+		_ = client.Close()
+	})
+
+	t.Run("inject", func(t *testing.T) {
+		d, l := DialerListener(1)
+		conns := make(chan *InterceptedConn, 1)
+		dialer := Intercept(d, func(chunk Chunk) [][]byte {
+			if chunk.Seq == 0 && chunk.Direction == ClientToServer {
+				conns <- chunk.Conn
+			}
+			return [][]byte{chunk.Data}
+		})
+		client, _ := dialer.Dial("tcp", "")
+		_, _ = l.Accept()
+		_, _ = client.Write([]byte("x"))
+		conn := <-conns
+		if err := conn.Inject(ServerToClient, []byte("injected")); err != nil {
+			t.Error(err)
+		}
+		received := make([]byte, 8)
+		_, _ = io.ReadFull(client, received)
+		if string(received) != "injected" {
+			t.Errorf("expecting %v, got %v", "injected", string(received))
+		}
+		_ = client.Close()
+	})
+
+	t.Run("datagrams and close", func(t *testing.T) {
+		d, l := DialerListener(1)
+		dialer := Intercept(d, func(chunk Chunk) [][]byte {
+			return [][]byte{chunk.Data, []byte("extra")}
+		})
+		client, _ := dialer.Dial("udp", "")
+		server, _ := l.ListenPacket("udp", "")
+		_, _ = client.Write([]byte("one"))
+		buf := make([]byte, 16)
+		for _, expected := range []string{"one", "extra"} {
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != expected {
+				t.Errorf("expecting %v, got %v", expected, string(buf[:n]))
+			}
+		}
+
+		_ = client.Close()
+		_ = server.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := server.ReadFrom(buf); err != io.ErrClosedPipe {
+			t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+		}
+	})
+}
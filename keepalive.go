@@ -0,0 +1,99 @@
+package connutil
+
+import (
+	"time"
+)
+
+// The defaults of *net.TCPConn keepalive on most platforms
+const (
+	defaultKeepAliveIdle     = 15 * time.Second
+	defaultKeepAliveInterval = 15 * time.Second
+	defaultKeepAliveCount    = 9
+)
+
+type activityReporter interface {
+	activity() (lastActive time.Time, frozen, closed bool)
+}
+
+// keepAliveParams returns the keepalive parameters in effect, with the defaults filled in
+func (opts SocketOptions) keepAliveParams() (idle, interval time.Duration, count int) {
+	idle, interval, count = defaultKeepAliveIdle, defaultKeepAliveInterval, defaultKeepAliveCount
+	if opts.KeepAlivePeriod > 0 {
+		idle = opts.KeepAlivePeriod
+	}
+	if opts.KeepAliveConfig.Idle > 0 {
+		idle = opts.KeepAliveConfig.Idle
+	}
+	if opts.KeepAliveConfig.Interval > 0 {
+		interval = opts.KeepAliveConfig.Interval
+	}
+	if opts.KeepAliveConfig.Count > 0 {
+		count = opts.KeepAliveConfig.Count
+	}
+	return
+}
+
+// restartKeepAlive must be called with conn.sockOptsM held, after the keepalive settings change
+//
+// Keepalive probes are emulated by checking whether the peer has vanished, that is, the pipe is frozen. The first probe
+// is sent once no data has been received for the idle time, and the rest are sent every interval while unanswered.
+// I/O on this end fails with ErrConnTimedOut one interval after count unanswered probes, as TCP does. Like a vanished
+// TCP peer, the other end is not told.
+func (conn *StreamPipe) restartKeepAlive() {
+	conn.keepAliveGen++
+	if !conn.sockOpts.KeepAlive {
+		return
+	}
+	idle, interval, count := conn.sockOpts.keepAliveParams()
+	conn.scheduleProbe(conn.keepAliveGen, idle, idle, interval, count, 0)
+}
+
+func (conn *StreamPipe) scheduleProbe(gen uint64, delay, idle, interval time.Duration, count, unanswered int) {
+	time.AfterFunc(delay, func() {
+		conn.sockOptsM.Lock()
+		current := gen == conn.keepAliveGen
+		conn.sockOptsM.Unlock()
+		if !current {
+			// keepalive has been reconfigured
+			return
+		}
+
+		lastActive, frozen, closed := conn.readEnd.activity()
+		switch {
+		case closed:
+		case unanswered == 0 && time.Since(lastActive) < idle:
+			// not idle for long enough yet
+			conn.scheduleProbe(gen, time.Until(lastActive.Add(idle)), idle, interval, count, 0)
+		case !frozen:
+			conn.scheduleProbe(gen, idle, idle, interval, count, 0)
+		case unanswered == count:
+			conn.readEnd.FailRead(ErrConnTimedOut)
+			conn.writeEnd.FailWrite(ErrConnTimedOut)
+		default:
+			conn.scheduleProbe(gen, interval, idle, interval, count, unanswered+1)
+		}
+	})
+}
+
+// watchIdle calls closeFn once there has been no traffic in any of directions for timeout
+func watchIdle(timeout time.Duration, closeFn func(), directions ...activityReporter) {
+	var check func()
+	check = func() {
+		var last time.Time
+		for _, direction := range directions {
+			lastActive, _, closed := direction.activity()
+			if closed {
+				return
+			}
+			if lastActive.After(last) {
+				last = lastActive
+			}
+		}
+		if idle := time.Since(last); idle < timeout {
+			time.AfterFunc(timeout-idle, check)
+			return
+		}
+		closeFn()
+	}
+	time.AfterFunc(timeout, check)
+}
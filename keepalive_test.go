@@ -0,0 +1,130 @@
+package connutil
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamPipe_KeepAlive(t *testing.T) {
+	config := net.KeepAliveConfig{Enable: true, Idle: 20 * time.Millisecond, Interval: 10 * time.Millisecond, Count: 3}
+
+	// dial returns the two ends of a pipe whose peer can be made to vanish with EstablishedFreeze
+	dial := func(t *testing.T) (*PipeDialer, *StreamPipe, net.Conn) {
+		d, l := DialerListener(1)
+		a, err := d.Dial("tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := l.Accept()
+		return d, a.(*StreamPipe), b
+	}
+
+	t.Run("vanished peer", func(t *testing.T) {
+		d, a, b := dial(t)
+		start := time.Now()
+		_ = a.SetKeepAliveConfig(config)
+		d.Controller().Partition(Partition{Established: EstablishedFreeze})
+		_, err := a.Read(make([]byte, 1))
+		if err != ErrConnTimedOut {
+			t.Errorf("expecting %v, got %v", ErrConnTimedOut, err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("expecting at least 50ms, got %v", elapsed)
+		}
+		if _, err := a.Write([]byte{0}); err != ErrConnTimedOut {
+			t.Errorf("expecting %v, got %v", ErrConnTimedOut, err)
+		}
+
+		// the peer is not told
+		_ = b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		if _, err := b.Read(make([]byte, 1)); err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+		if _, err := b.Write([]byte{0}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("idle measured from last activity", func(t *testing.T) {
+		d, a, b := dial(t)
+		_ = a.SetKeepAliveConfig(config)
+		time.Sleep(15 * time.Millisecond)
+		_, _ = b.Write([]byte{1})
+		_, _ = a.Read(make([]byte, 1))
+		lastActive := time.Now()
+		d.Controller().Partition(Partition{Established: EstablishedFreeze})
+		if _, err := a.Read(make([]byte, 1)); err != ErrConnTimedOut {
+			t.Errorf("expecting %v, got %v", ErrConnTimedOut, err)
+		}
+		if elapsed := time.Since(lastActive); elapsed < 50*time.Millisecond {
+			t.Errorf("expecting at least 50ms, got %v", elapsed)
+		}
+	})
+
+	t.Run("live peer", func(t *testing.T) {
+		a, b := AsyncPipe()
+		defer a.Close()
+		_ = a.SetKeepAliveConfig(config)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = b.Write([]byte{1})
+		if _, err := a.Read(make([]byte, 1)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("peer comes back", func(t *testing.T) {
+		d, a, b := dial(t)
+		defer a.Close()
+		_ = a.SetKeepAliveConfig(config)
+		d.Controller().Partition(Partition{Established: EstablishedFreeze})
+		time.Sleep(30 * time.Millisecond)
+		d.Controller().Heal()
+		time.Sleep(100 * time.Millisecond)
+		_, _ = b.Write([]byte{1})
+		if _, err := a.Read(make([]byte, 1)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("keepalive disabled", func(t *testing.T) {
+		d, a, _ := dial(t)
+		defer a.Close()
+		_ = a.SetKeepAliveConfig(config)
+		_ = a.SetKeepAlive(false)
+		d.Controller().Partition(Partition{Established: EstablishedFreeze})
+		_ = a.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := a.Read(make([]byte, 1)); err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	t.Run("stream", func(t *testing.T) {
+		a, b := AsyncPipe(WithIdleTimeout(50 * time.Millisecond))
+		buf := make([]byte, 1)
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			_, _ = a.Write([]byte{1})
+			if _, err := b.Read(buf); err != nil {
+				t.Fatalf("closed while active: %v", err)
+			}
+		}
+		start := time.Now()
+		if _, err := b.Read(buf); err != io.ErrClosedPipe {
+			t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+		}
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+			t.Errorf("expecting about 50ms, got %v", elapsed)
+		}
+	})
+
+	t.Run("packet", func(t *testing.T) {
+		a, _ := AsyncPacketPipe(WithIdleTimeout(50 * time.Millisecond))
+		if _, err := a.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+			t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+		}
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package connutil
+
+// Values from Linux, as the syscall package doesn't define them on this platform
+const (
+	msgTrunc  = 0x20
+	msgCtrunc = 0x8
+)
@@ -0,0 +1,10 @@
+//go:build unix
+
+package connutil
+
+import "syscall"
+
+const (
+	msgTrunc  = syscall.MSG_TRUNC
+	msgCtrunc = syscall.MSG_CTRUNC
+)
@@ -0,0 +1,250 @@
+package connutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errMissingAddress is returned by writes without a destination, as net.UDPConn does
+var errMissingAddress = errors.New("missing address")
+
+// MulticastHub is an in-memory network on which datagrams can be sent to a single member, to every member of a
+// multicast group, or broadcast to every member.
+//
+// Each member has its own receive buffer, limited to the size given to ListenPacket. Like in
+// LimitedAsyncPacketPipe, a datagram is accepted as long as the buffered size doesn't exceed the limit. But instead of
+// blocking the writer, datagrams arriving at a full buffer are dropped for that member only, and counted in
+// Stats().Received.Dropped of the member.
+type MulticastHub struct {
+	mu       sync.Mutex
+	members  map[string]*HubConn
+	groups   map[string]map[*HubConn]struct{}
+	nextPort int
+}
+
+// NewMulticastHub returns an empty MulticastHub
+func NewMulticastHub() *MulticastHub {
+	return &MulticastHub{
+		members:  make(map[string]*HubConn),
+		groups:   make(map[string]map[*HubConn]struct{}),
+		nextPort: 49152,
+	}
+}
+
+// ListenPacket adds a member to the hub with the unicast address addr. If addr is nil, it gets an address of
+// 127.0.0.1 and an unused port. If addr has a zero port, an unused port is chosen.
+//
+// bufferSizeLimit limits the size of the member's receive buffer. Default (0) means unlimited.
+func (h *MulticastHub) ListenPacket(addr *net.UDPAddr, bufferSizeLimit int) (*HubConn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if addr == nil {
+		addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	} else {
+		copied := *addr
+		addr = &copied
+	}
+	if addr.Port == 0 {
+		for {
+			addr.Port = h.nextPort
+			h.nextPort++
+			if _, ok := h.members[addr.String()]; !ok {
+				break
+			}
+		}
+	}
+	if _, ok := h.members[addr.String()]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: addr, Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	}
+
+	queue := newBufferedPacketPipe(bufferSizeLimit)
+	queue.lossy = true
+	c := &HubConn{
+		hub:    h,
+		addr:   addr,
+		queue:  queue,
+		groups: make(map[string]struct{}),
+	}
+	h.members[addr.String()] = c
+	return c, nil
+}
+
+func (h *MulticastHub) join(c *HubConn, group string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	members, ok := h.groups[group]
+	if !ok {
+		members = make(map[*HubConn]struct{})
+		h.groups[group] = members
+	}
+	members[c] = struct{}{}
+	c.groups[group] = struct{}{}
+}
+
+func (h *MulticastHub) leave(c *HubConn, group string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.groups[group], c)
+	if len(h.groups[group]) == 0 {
+		delete(h.groups, group)
+	}
+	delete(c.groups, group)
+}
+
+func (h *MulticastHub) remove(c *HubConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for group := range c.groups {
+		delete(h.groups[group], c)
+		if len(h.groups[group]) == 0 {
+			delete(h.groups, group)
+		}
+	}
+	if h.members[c.addr.String()] == c {
+		delete(h.members, c.addr.String())
+	}
+}
+
+// recipients returns the members a datagram sent to dst is delivered to
+func (h *MulticastHub) recipients(dst *net.UDPAddr) []*HubConn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var recipients []*HubConn
+	switch {
+	case dst.IP.IsMulticast():
+		for member := range h.groups[dst.String()] {
+			recipients = append(recipients, member)
+		}
+	case dst.IP.Equal(net.IPv4bcast):
+		for _, member := range h.members {
+			if member.addr.Port == dst.Port {
+				recipients = append(recipients, member)
+			}
+		}
+	default:
+		if member, ok := h.members[dst.String()]; ok {
+			recipients = append(recipients, member)
+		}
+	}
+	return recipients
+}
+
+// HubConn is a member of a MulticastHub. It implements net.PacketConn.
+type HubConn struct {
+	hub   *MulticastHub
+	addr  *net.UDPAddr
+	queue *bufferedPacketPipe
+
+	// protected by hub.mu
+	groups map[string]struct{}
+
+	mu        sync.Mutex
+	closed    bool
+	wDeadline time.Time
+}
+
+// JoinGroup makes the member receive datagrams sent to group, which must be a multicast address
+func (c *HubConn) JoinGroup(group *net.UDPAddr) error {
+	if !group.IP.IsMulticast() {
+		return fmt.Errorf("%v is not a multicast address", group)
+	}
+	c.hub.join(c, group.String())
+	return nil
+}
+
+// LeaveGroup stops the member from receiving datagrams sent to group
+func (c *HubConn) LeaveGroup(group *net.UDPAddr) error {
+	c.hub.leave(c, group.String())
+	return nil
+}
+
+// ReadFrom implements the net.PacketConn ReadFrom method. addr is the unicast address of the sender.
+func (c *HubConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, _, _, addr, err = c.queue.ReadMsg(p, nil)
+	return
+}
+
+// WriteTo implements the net.PacketConn WriteTo method. If addr is a multicast group, the datagram is delivered to
+// every member of the group, including the sender if it has joined the group. If addr is the IPv4 broadcast address,
+// the datagram is delivered to every member listening on the port of addr. Datagrams sent to an address with no
+// member are silently dropped.
+//
+// WriteTo never blocks.
+func (c *HubConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	closed, deadline := c.closed, c.wDeadline
+	c.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	if !deadline.IsZero() && time.Until(deadline) <= 0 {
+		return 0, ErrTimeout
+	}
+
+	dst, ok := addr.(*net.UDPAddr)
+	if addr == nil || ok && dst == nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.addr, Err: errMissingAddress}
+	}
+	if !ok {
+		var err error
+		if dst, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+			return 0, &net.OpError{Op: "write", Net: "udp", Source: c.addr, Addr: addr, Err: err}
+		}
+	}
+	for _, recipient := range c.hub.recipients(dst) {
+		// the recipient may have been closed in the meantime, which drops the datagram just like a full buffer
+		_, _ = recipient.queue.WriteMsg(p, nil, c.addr)
+	}
+	return len(p), nil
+}
+
+// Close implements the net.PacketConn Close method. It removes the member from the hub.
+func (c *HubConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.hub.remove(c)
+	c.queue.Close()
+	return nil
+}
+
+// LocalAddr implements the net.PacketConn LocalAddr method. It returns the unicast address of the member.
+func (c *HubConn) LocalAddr() net.Addr { return c.addr }
+
+// SetReadDeadline implements the net.PacketConn SetReadDeadline method.
+func (c *HubConn) SetReadDeadline(t time.Time) error {
+	c.queue.SetReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.PacketConn SetWriteDeadline method.
+func (c *HubConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wDeadline = t
+	return nil
+}
+
+// SetDeadline implements the net.PacketConn SetDeadline method.
+func (c *HubConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	_ = c.SetWriteDeadline(t)
+	return nil
+}
+
+// Stats returns the traffic statistics of the member's receive buffer as Received. Sent is always empty, as
+// datagrams sent by the member are accounted in the receive buffers of their recipients.
+func (c *HubConn) Stats() Stats {
+	return Stats{Received: c.queue.Stats()}
+}
@@ -0,0 +1,113 @@
+package connutil
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMulticastHub_Group(t *testing.T) {
+	hub := NewMulticastHub()
+	group := &net.UDPAddr{IP: net.ParseIP("224.0.0.251"), Port: 5353}
+
+	sender, _ := hub.ListenPacket(nil, 0)
+	var members []*HubConn
+	for i := 0; i < 3; i++ {
+		m, err := hub.ListenPacket(nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = m.JoinGroup(group)
+		members = append(members, m)
+	}
+	_ = members[2].LeaveGroup(group)
+
+	_, err := sender.WriteTo([]byte("query"), group)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, m := range members[:2] {
+		buf := make([]byte, 16)
+		_ = m.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, addr, err := m.ReadFrom(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(buf[:n]) != "query" || addr.String() != sender.LocalAddr().String() {
+			t.Errorf("expecting query from %v, got %q from %v", sender.LocalAddr(), buf[:n], addr)
+		}
+	}
+
+	// left the group
+	_ = members[2].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err = members[2].ReadFrom(make([]byte, 16)); err != ErrTimeout {
+		t.Errorf("expecting %v, got %v", ErrTimeout, err)
+	}
+	// not a member
+	_ = sender.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err = sender.ReadFrom(make([]byte, 16)); err != ErrTimeout {
+		t.Errorf("expecting %v, got %v", ErrTimeout, err)
+	}
+}
+
+func TestMulticastHub_UnicastBroadcast(t *testing.T) {
+	hub := NewMulticastHub()
+	a, _ := hub.ListenPacket(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1900}, 0)
+	b, _ := hub.ListenPacket(&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1900}, 0)
+	c, _ := hub.ListenPacket(&net.UDPAddr{IP: net.ParseIP("192.0.2.3"), Port: 1901}, 0)
+
+	if _, err := hub.ListenPacket(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1900}, 0); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("expecting %v, got %v", syscall.EADDRINUSE, err)
+	}
+
+	_, _ = a.WriteTo([]byte("unicast"), b.LocalAddr())
+	buf := make([]byte, 16)
+	n, _, _ := b.ReadFrom(buf)
+	if string(buf[:n]) != "unicast" {
+		t.Errorf("expecting unicast, got %q", buf[:n])
+	}
+
+	_, _ = c.WriteTo([]byte("broadcast"), &net.UDPAddr{IP: net.IPv4bcast, Port: 1900})
+	for _, m := range []*HubConn{a, b} {
+		n, _, _ = m.ReadFrom(buf)
+		if string(buf[:n]) != "broadcast" {
+			t.Errorf("expecting broadcast, got %q", buf[:n])
+		}
+	}
+
+	for _, addr := range []net.Addr{nil, (*net.UDPAddr)(nil)} {
+		var opErr *net.OpError
+		if _, err := c.WriteTo([]byte("nowhere"), addr); !errors.As(err, &opErr) {
+			t.Errorf("expecting *net.OpError for %v, got %v", addr, err)
+		}
+	}
+
+	_ = c.Close()
+	if _, err := c.WriteTo([]byte("closed"), a.LocalAddr()); err == nil {
+		t.Error("writing to a closed member should fail")
+	}
+}
+
+func TestMulticastHub_DropOnFull(t *testing.T) {
+	hub := NewMulticastHub()
+	group := &net.UDPAddr{IP: net.ParseIP("239.255.255.250"), Port: 1900}
+	sender, _ := hub.ListenPacket(nil, 0)
+	slow, _ := hub.ListenPacket(nil, 10)
+	fast, _ := hub.ListenPacket(nil, 0)
+	_ = slow.JoinGroup(group)
+	_ = fast.JoinGroup(group)
+
+	for i := 0; i < 5; i++ {
+		if _, err := sender.WriteTo(make([]byte, 8), group); err != nil {
+			t.Error(err)
+		}
+	}
+	if dropped := slow.Stats().Received.Dropped; dropped != 3 {
+		t.Errorf("expecting 3 datagrams dropped, got %v", dropped)
+	}
+	if fast.Stats().Received.Dropped != 0 || fast.Stats().Received.PacketsWritten != 5 {
+		t.Errorf("the member without buffer limit should receive every datagram, got %+v", fast.Stats().Received)
+	}
+}
@@ -0,0 +1,447 @@
+package connutil
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	muxFrameSYN = iota
+	muxFrameData
+	muxFrameWindow
+	muxFrameFIN
+	muxFrameRST
+	muxFrameGoAway
+)
+
+const (
+	muxHeaderLen = 9
+	// DefaultMuxWindowSize is the per-stream flow-control window used when NewMuxSession is given a window size of 0
+	DefaultMuxWindowSize = 256 * 1024
+	muxMaxFrameSize      = 16 * 1024
+	muxAcceptBacklog     = 64
+	// muxCloseTimeout bounds how long Close waits for GoAway to be sent, when the peer isn't reading
+	muxCloseTimeout = time.Second
+)
+
+// MuxSession multiplexes many logical streams over a single net.Conn, such as a StreamPipe.
+//
+// Every stream has its own flow-control window: a stream can only have windowSize bytes in flight before the peer
+// reads them, and Write blocks until the window opens up again. All streams share the underlying conn, so a stalled
+// underlying conn blocks every stream, as in a real multiplexed transport.
+//
+// MuxSession implements net.Listener. Accept returns the streams opened by the peer.
+type MuxSession struct {
+	conn       net.Conn
+	windowSize int
+
+	writeM sync.Mutex
+
+	// control frames are queued and sent by controlLoop, so that they never block the goroutine sending them
+	controlM    sync.Mutex
+	controlCond sync.Cond
+	control     []muxControlFrame
+
+	streamsM sync.Mutex
+	streams  map[uint32]*MuxStream
+	nextID   uint32
+
+	accept    chan *MuxStream
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewMuxSession starts a session over conn. The two ends of conn must have different values of isClient.
+// windowSize specifies the flow-control window of each stream. Default (0) means DefaultMuxWindowSize.
+//
+// The session owns conn from now on and closes it when the session is closed.
+func NewMuxSession(conn net.Conn, isClient bool, windowSize int) *MuxSession {
+	if windowSize == 0 {
+		windowSize = DefaultMuxWindowSize
+	}
+	s := &MuxSession{
+		conn:       conn,
+		windowSize: windowSize,
+		streams:    make(map[uint32]*MuxStream),
+		nextID:     2,
+		accept:     make(chan *MuxStream, muxAcceptBacklog),
+		done:       make(chan struct{}),
+	}
+	if isClient {
+		s.nextID = 1
+	}
+	s.controlCond.L = &s.controlM
+	go s.recvLoop()
+	go s.controlLoop()
+	return s
+}
+
+type muxControlFrame struct {
+	frame []byte
+	// sent is closed once the frame is written to the conn
+	sent chan struct{}
+}
+
+func encodeMuxFrame(frameType byte, id uint32, length uint32, payload []byte) []byte {
+	frame := make([]byte, muxHeaderLen, muxHeaderLen+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], length)
+	return append(frame, payload...)
+}
+
+func (s *MuxSession) writeFrame(frameType byte, id uint32, length uint32, payload []byte) error {
+	s.writeM.Lock()
+	defer s.writeM.Unlock()
+
+	_, err := s.conn.Write(encodeMuxFrame(frameType, id, length, payload))
+	return err
+}
+
+// sendControl queues a control frame without blocking. The returned channel is closed once the frame is sent.
+func (s *MuxSession) sendControl(frameType byte, id uint32) <-chan struct{} {
+	sent := make(chan struct{})
+	s.controlM.Lock()
+	s.control = append(s.control, muxControlFrame{frame: encodeMuxFrame(frameType, id, 0, nil), sent: sent})
+	s.controlCond.Signal()
+	s.controlM.Unlock()
+	return sent
+}
+
+func (s *MuxSession) controlLoop() {
+	for {
+		s.controlM.Lock()
+		for len(s.control) == 0 && !s.isClosed() {
+			s.controlCond.Wait()
+		}
+		if s.isClosed() {
+			s.control = nil
+			s.controlM.Unlock()
+			return
+		}
+		next := s.control[0]
+		s.control[0] = muxControlFrame{}
+		s.control = s.control[1:]
+		s.controlM.Unlock()
+
+		s.writeM.Lock()
+		_, err := s.conn.Write(next.frame)
+		s.writeM.Unlock()
+		if err != nil {
+			return
+		}
+		close(next.sent)
+	}
+}
+
+func (s *MuxSession) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *MuxSession) newStream(id uint32) *MuxStream {
+	stream := &MuxStream{
+		id:         id,
+		session:    s,
+		recv:       newBufferedPipe(0),
+		sendWindow: s.windowSize,
+	}
+	stream.sendCond.L = &stream.sendM
+	s.streams[id] = stream
+	return stream
+}
+
+// Open opens a new stream to the peer
+func (s *MuxSession) Open() (*MuxStream, error) {
+	s.streamsM.Lock()
+	select {
+	case <-s.done:
+		s.streamsM.Unlock()
+		return nil, ErrMuxSessionClosed
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := s.newStream(id)
+	s.streamsM.Unlock()
+
+	if err := s.writeFrame(muxFrameSYN, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept implements net.Listener Accept method. It returns the next stream opened by the peer.
+func (s *MuxSession) Accept() (net.Conn, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, ErrMuxSessionClosed
+	}
+}
+
+// Addr implements net.Listener Addr method. It returns the local address of the underlying conn.
+func (s *MuxSession) Addr() net.Addr { return s.conn.LocalAddr() }
+
+// Close closes the session, all of its streams and the underlying conn. The peer is notified if possible, but Close
+// doesn't wait for more than a second if the peer isn't reading from the underlying conn.
+func (s *MuxSession) Close() error {
+	sent := s.sendControl(muxFrameGoAway, 0)
+	timer := time.NewTimer(muxCloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-sent:
+	case <-s.done:
+	case <-timer.C:
+	}
+	s.shutdown()
+	return nil
+}
+
+// NumStreams returns the number of streams not yet closed
+func (s *MuxSession) NumStreams() int {
+	s.streamsM.Lock()
+	defer s.streamsM.Unlock()
+	return len(s.streams)
+}
+
+func (s *MuxSession) shutdown() {
+	s.closeOnce.Do(func() {
+		s.controlM.Lock()
+		close(s.done)
+		s.controlCond.Broadcast()
+		s.controlM.Unlock()
+		s.conn.Close()
+
+		s.streamsM.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*MuxStream)
+		s.streamsM.Unlock()
+		for _, stream := range streams {
+			stream.closeLocally(ErrMuxSessionClosed)
+		}
+	})
+}
+
+func (s *MuxSession) getStream(id uint32) *MuxStream {
+	s.streamsM.Lock()
+	defer s.streamsM.Unlock()
+	return s.streams[id]
+}
+
+func (s *MuxSession) removeStream(id uint32) {
+	s.streamsM.Lock()
+	defer s.streamsM.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *MuxSession) recvLoop() {
+	defer s.shutdown()
+	header := make([]byte, muxHeaderLen)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+
+		switch frameType {
+		case muxFrameSYN:
+			s.streamsM.Lock()
+			stream := s.newStream(id)
+			s.streamsM.Unlock()
+			select {
+			case s.accept <- stream:
+			default:
+				// backlog is full
+				s.removeStream(id)
+				s.sendControl(muxFrameRST, id)
+			}
+		case muxFrameData:
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				return
+			}
+			if stream := s.getStream(id); stream != nil {
+				_, _ = stream.recv.Write(payload)
+			} else {
+				// the stream has been closed, so the data will never be read and its window never credited.
+				// Reset the peer's end, as TCP does when data arrives at a closed socket.
+				s.sendControl(muxFrameRST, id)
+			}
+		case muxFrameWindow:
+			if stream := s.getStream(id); stream != nil {
+				stream.sendM.Lock()
+				stream.sendWindow += int(length)
+				stream.sendCond.Broadcast()
+				stream.sendM.Unlock()
+			}
+		case muxFrameFIN:
+			if stream := s.getStream(id); stream != nil {
+				stream.recv.CloseWrite()
+			}
+		case muxFrameRST:
+			if stream := s.getStream(id); stream != nil {
+				s.removeStream(id)
+				stream.closeLocally(ErrConnReset)
+			}
+		case muxFrameGoAway:
+			return
+		default:
+			return
+		}
+	}
+}
+
+// MuxStream is a logical stream of a MuxSession. It implements net.Conn.
+type MuxStream struct {
+	id      uint32
+	session *MuxSession
+	recv    *bufferedPipe
+
+	sendM      sync.Mutex
+	sendCond   sync.Cond
+	sendWindow int
+	finSent    bool
+	sendErr    error
+	wDeadline  time.Time
+}
+
+// ID returns the stream ID. IDs of streams opened by the client end are odd, and even for the server end.
+func (st *MuxStream) ID() uint32 { return st.id }
+
+// Read implements net.Conn Read method. It returns io.EOF after the peer has half-closed the stream and all data
+// has been read.
+func (st *MuxStream) Read(b []byte) (int, error) {
+	n, err := st.recv.Read(b)
+	if n > 0 {
+		// advertise the window freed up by this read
+		_ = st.session.writeFrame(muxFrameWindow, st.id, uint32(n), nil)
+	}
+	return n, err
+}
+
+// Write implements net.Conn Write method. It blocks while the stream's flow-control window is exhausted. If the write
+// deadline is reached while blocked, the number of bytes already sent is returned along with ErrTimeout.
+func (st *MuxStream) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		st.sendM.Lock()
+		for {
+			if st.sendErr != nil {
+				st.sendM.Unlock()
+				return n, st.sendErr
+			}
+			if st.finSent {
+				st.sendM.Unlock()
+				return n, io.ErrClosedPipe
+			}
+			if !st.wDeadline.IsZero() {
+				d := time.Until(st.wDeadline)
+				if d <= 0 {
+					st.sendM.Unlock()
+					return n, ErrTimeout
+				}
+				time.AfterFunc(d, st.sendCond.Broadcast)
+			}
+			if st.sendWindow > 0 {
+				break
+			}
+			st.sendCond.Wait()
+		}
+		chunk := len(b) - n
+		if chunk > st.sendWindow {
+			chunk = st.sendWindow
+		}
+		if chunk > muxMaxFrameSize {
+			chunk = muxMaxFrameSize
+		}
+		st.sendWindow -= chunk
+		st.sendM.Unlock()
+
+		if err = st.session.writeFrame(muxFrameData, st.id, uint32(chunk), b[n:n+chunk]); err != nil {
+			return n, err
+		}
+		n += chunk
+	}
+	return n, nil
+}
+
+// CloseWrite half-closes the stream. The peer reads io.EOF after consuming all data sent, and can still send data
+// back.
+func (st *MuxStream) CloseWrite() error {
+	st.sendM.Lock()
+	if st.finSent || st.sendErr != nil {
+		st.sendM.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.sendCond.Broadcast()
+	st.sendM.Unlock()
+	return st.session.writeFrame(muxFrameFIN, st.id, 0, nil)
+}
+
+// Close half-closes the stream for writing, and stops reading from it. If the peer sends more data afterwards, its
+// end is reset, so that its pending and future I/O fails with ErrConnReset instead of blocking once the window is
+// exhausted.
+func (st *MuxStream) Close() error {
+	err := st.CloseWrite()
+	st.session.removeStream(st.id)
+	st.closeLocally(io.ErrClosedPipe)
+	return err
+}
+
+// Reset aborts the stream. Pending and future I/O on the peer's end fails with ErrConnReset.
+func (st *MuxStream) Reset() error {
+	st.session.removeStream(st.id)
+	st.closeLocally(io.ErrClosedPipe)
+	return st.session.writeFrame(muxFrameRST, st.id, 0, nil)
+}
+
+func (st *MuxStream) closeLocally(err error) {
+	st.recv.CloseWithError(err)
+	st.sendM.Lock()
+	if st.sendErr == nil {
+		st.sendErr = err
+	}
+	st.sendCond.Broadcast()
+	st.sendM.Unlock()
+}
+
+// SetReadDeadline implements net.Conn SetReadDeadline method.
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.recv.SetReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn SetWriteDeadline method.
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.sendM.Lock()
+	defer st.sendM.Unlock()
+
+	st.wDeadline = t
+	st.sendCond.Broadcast()
+	return nil
+}
+
+// SetDeadline implements net.Conn SetDeadline method.
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	_ = st.SetWriteDeadline(t)
+	return nil
+}
+
+// LocalAddr implements net.Conn LocalAddr method. It returns the local address of the underlying conn.
+func (st *MuxStream) LocalAddr() net.Addr { return st.session.conn.LocalAddr() }
+
+// RemoteAddr implements net.Conn RemoteAddr method. It returns the remote address of the underlying conn.
+func (st *MuxStream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
@@ -0,0 +1,229 @@
+package connutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func muxPair(windowSize int) (*MuxSession, *MuxSession) {
+	a, b := AsyncPipe()
+	return NewMuxSession(a, true, windowSize), NewMuxSession(b, false, windowSize)
+}
+
+func TestMuxSession_OpenAccept(t *testing.T) {
+	client, server := muxPair(0)
+	defer client.Close()
+
+	const numStreams = 8
+	testData := make([]byte, 1<<20)
+	rand.Read(testData)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numStreams; i++ {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := stream.Write(testData)
+			if err != nil {
+				t.Error(err)
+			}
+			_ = stream.CloseWrite()
+		}()
+	}
+
+	for i := 0; i < numStreams; i++ {
+		stream, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recvBuf, err := io.ReadAll(stream)
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(testData, recvBuf) {
+				t.Error("read incorrect data")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMuxStream_FlowControl(t *testing.T) {
+	const window = 1024
+	client, server := muxPair(window)
+	defer client.Close()
+
+	stream, _ := client.Open()
+	peer, _ := server.Accept()
+
+	_ = stream.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := stream.Write(make([]byte, 4*window))
+	if err != ErrTimeout {
+		t.Errorf("expecting %v, got %v", ErrTimeout, err)
+	}
+	if n != window {
+		t.Errorf("expecting %v bytes sent before the window is exhausted, got %v", window, n)
+	}
+
+	// reading on the peer end opens up the window again
+	_, _ = io.ReadFull(peer, make([]byte, window))
+	_ = stream.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	n, err = stream.Write(make([]byte, window))
+	if err != nil {
+		t.Error(err)
+	}
+	if n != window {
+		t.Errorf("expecting %v bytes written, got %v", window, n)
+	}
+}
+
+func TestMuxStream_HalfClose(t *testing.T) {
+	client, server := muxPair(0)
+	defer client.Close()
+
+	stream, _ := client.Open()
+	peer, _ := server.Accept()
+
+	_, _ = stream.Write([]byte("hello"))
+	_ = stream.CloseWrite()
+	if _, err := stream.Write([]byte("hello")); err != io.ErrClosedPipe {
+		t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+	}
+
+	recvBuf, err := io.ReadAll(peer)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(recvBuf) != "hello" {
+		t.Errorf("expecting hello, got %q", recvBuf)
+	}
+
+	// the other direction still works
+	_, err = peer.Write([]byte("world"))
+	if err != nil {
+		t.Error(err)
+	}
+	recvBuf = make([]byte, 5)
+	_, err = io.ReadFull(stream, recvBuf)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMuxStream_Reset(t *testing.T) {
+	client, server := muxPair(0)
+	defer client.Close()
+
+	stream, _ := client.Open()
+	peer, _ := server.Accept()
+
+	done := make(chan error)
+	go func() {
+		_, err := peer.Read(make([]byte, 1))
+		done <- err
+	}()
+	_ = stream.Reset()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrConnReset) {
+			t.Errorf("expecting %v, got %v", ErrConnReset, err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("Read did not unblock after reset")
+	}
+	if _, err := peer.Write([]byte("hello")); !errors.Is(err, ErrConnReset) {
+		t.Errorf("expecting %v, got %v", ErrConnReset, err)
+	}
+}
+
+func TestMuxStream_WriteAfterPeerClose(t *testing.T) {
+	client, server := muxPair(1024)
+	defer client.Close()
+
+	stream, _ := client.Open()
+	peer, _ := server.Accept()
+	_ = peer.Close()
+
+	_ = stream.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := stream.Write(make([]byte, 4096)); !errors.Is(err, ErrConnReset) {
+		t.Errorf("expecting %v, got %v", ErrConnReset, err)
+	}
+}
+
+func TestMuxSession_Close(t *testing.T) {
+	client, server := muxPair(0)
+	stream, _ := client.Open()
+	peer, _ := server.Accept()
+
+	_ = client.Close()
+	if _, err := peer.Read(make([]byte, 1)); err != ErrMuxSessionClosed {
+		t.Errorf("expecting %v, got %v", ErrMuxSessionClosed, err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != ErrMuxSessionClosed {
+		t.Errorf("expecting %v, got %v", ErrMuxSessionClosed, err)
+	}
+	if _, err := server.Accept(); err != ErrMuxSessionClosed {
+		t.Errorf("expecting %v, got %v", ErrMuxSessionClosed, err)
+	}
+	if _, err := client.Open(); err != ErrMuxSessionClosed {
+		t.Errorf("expecting %v, got %v", ErrMuxSessionClosed, err)
+	}
+}
+
+func TestMuxSession_StalledPeer(t *testing.T) {
+	t.Run("close", func(t *testing.T) {
+		a, _ := LimitedAsyncPipe(1024)
+		session := NewMuxSession(a, true, 0)
+		stream, _ := session.Open()
+		go func() {
+			// blocks once the pipe is full, as nothing reads from the other end
+			_, _ = stream.Write(make([]byte, 64*1024))
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			_ = session.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("Close blocked on a stalled peer")
+		}
+	})
+
+	t.Run("rejecting streams", func(t *testing.T) {
+		a, b := LimitedAsyncPipe(16)
+		session := NewMuxSession(a, false, 0)
+		defer session.Close()
+		// overflow the accept backlog, so that the session sends more RSTs than the pipe holds
+		for i := 0; i < muxAcceptBacklog+16; i++ {
+			_, _ = b.Write(encodeMuxFrame(muxFrameSYN, uint32(2*i+1), 0, nil))
+		}
+		_, _ = b.Write(encodeMuxFrame(muxFrameGoAway, 0, 0, nil))
+
+		accepted := 0
+		for {
+			if _, err := session.Accept(); err != nil {
+				break
+			}
+			accepted++
+		}
+		if accepted > muxAcceptBacklog {
+			t.Errorf("expecting at most %v, got %v", muxAcceptBacklog, accepted)
+		}
+	})
+}
@@ -1,20 +1,148 @@
 package connutil
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
-type NullReader struct{}
+// NullReader is a source of zeros. The zero value is infinite, and fills the whole buffer on every Read. Use
+// NewNullReader to create one with a finite length, a fixed chunk size or a limited rate.
+type NullReader struct {
+	// remaining is only meaningful if limited is set
+	limited   bool
+	remaining int64
+	// closeAtEnd makes the reader end with io.ErrClosedPipe instead of io.EOF
+	closeAtEnd bool
+	chunkSize  int
+	// rate is in bytes/sec, 0 means unlimited
+	rate     int
+	start    time.Time
+	produced int64
+}
+
+// NullReaderOption configures a NullReader created by NewNullReader
+type NullReaderOption func(*NullReader)
+
+// NullLength makes the NullReader produce n bytes in total. Read returns io.EOF afterwards, unless NullCloseAtEnd is
+// also given.
+func NullLength(n int64) NullReaderOption {
+	return func(r *NullReader) {
+		r.limited = true
+		r.remaining = n
+	}
+}
+
+// NullCloseAtEnd makes the NullReader end with io.ErrClosedPipe instead of io.EOF after the length set by NullLength
+// is reached. A Babel conn reading from such source closes itself, as if the server has closed the connection.
+func NullCloseAtEnd() NullReaderOption {
+	return func(r *NullReader) {
+		r.closeAtEnd = true
+	}
+}
+
+// NullChunkSize makes every Read produce at most n bytes, regardless of the size of the buffer
+func NullChunkSize(n int) NullReaderOption {
+	return func(r *NullReader) {
+		r.chunkSize = n
+	}
+}
+
+// NullRate limits the rate the NullReader produces data, in bytes/sec. Read blocks until the data can be produced.
+// Unless NullChunkSize is also given, every Read produces at most as much data as produced in 10ms.
+func NullRate(bytesPerSec int) NullReaderOption {
+	return func(r *NullReader) {
+		r.rate = bytesPerSec
+	}
+}
+
+// NewNullReader creates a NullReader with the options given
+func NewNullReader(opts ...NullReaderOption) *NullReader {
+	r := &NullReader{}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// nonBlocking reports whether Read returns immediately, which is the case without a rate limit
+func (n *NullReader) nonBlocking() bool { return n.rate == 0 }
 
 func (n *NullReader) Read(b []byte) (int, error) {
+	return n.read(b, nil)
+}
+
+// read returns io.ErrClosedPipe early if cancel is closed while waiting for the rate limit
+func (n *NullReader) read(b []byte, cancel <-chan struct{}) (int, error) {
 	l := len(b)
+	if n.limited {
+		if n.remaining == 0 {
+			if n.closeAtEnd {
+				return 0, io.ErrClosedPipe
+			}
+			return 0, io.EOF
+		}
+		if int64(l) > n.remaining {
+			l = int(n.remaining)
+		}
+	}
+	if n.chunkSize > 0 && l > n.chunkSize {
+		l = n.chunkSize
+	}
+	if n.rate > 0 {
+		if n.chunkSize == 0 {
+			perTick := n.rate / 100
+			if perTick < 1 {
+				perTick = 1
+			}
+			if l > perTick {
+				l = perTick
+			}
+		}
+		if n.start.IsZero() {
+			n.start = time.Now()
+		}
+		due := n.start.Add(time.Duration(float64(n.produced+int64(l)) / float64(n.rate) * float64(time.Second)))
+		if d := time.Until(due); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-cancel:
+				timer.Stop()
+				return 0, io.ErrClosedPipe
+			}
+		}
+	}
+
 	for i := 0; i < l; i++ {
 		b[i] = 0
 	}
+	n.produced += int64(l)
+	if n.limited {
+		n.remaining -= int64(l)
+	}
 	return l, nil
 }
 
 func (n *NullReader) WriteTo(w io.Writer) (i int64, err error) {
 	null := make([]byte, 16*1024)
 	var written int
+	if n.limited || n.chunkSize > 0 || n.rate > 0 {
+		for {
+			var read int
+			read, err = n.Read(null)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return
+			}
+			written, err = w.Write(null[:read])
+			i += int64(written)
+			if err != nil {
+				return
+			}
+		}
+	}
 	for err == nil {
 		written, err = w.Write(null)
 		i += int64(written)
@@ -34,3 +34,94 @@ func TestNullReader_WriteTo(t *testing.T) {
 		t.Error("not finished after deadline")
 	}
 }
+
+func TestNullReader_Options(t *testing.T) {
+	t.Run("length", func(t *testing.T) {
+		r := NewNullReader(NullLength(1000))
+		n, err := io.Copy(io.Discard, r)
+		if err != nil {
+			t.Error(err)
+		}
+		if n != 1000 {
+			t.Errorf("expecting %v, got %v", 1000, n)
+		}
+		_, err = r.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("expecting %v, got %v", io.EOF, err)
+		}
+	})
+
+	t.Run("close at end", func(t *testing.T) {
+		r := NewNullReader(NullLength(10), NullCloseAtEnd())
+		_, _ = r.Read(make([]byte, 100))
+		_, err := r.Read(make([]byte, 100))
+		if err != io.ErrClosedPipe {
+			t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+		}
+	})
+
+	t.Run("chunk size", func(t *testing.T) {
+		r := NewNullReader(NullChunkSize(7))
+		n, _ := r.Read(make([]byte, 100))
+		if n != 7 {
+			t.Errorf("expecting %v, got %v", 7, n)
+		}
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		r := NewNullReader(NullLength(50000), NullRate(200000))
+		start := time.Now()
+		n, _ := r.WriteTo(io.Discard)
+		if n != 50000 {
+			t.Errorf("expecting %v, got %v", 50000, n)
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("expecting at least 200ms, got %v", elapsed)
+		}
+	})
+}
+
+func TestNullReader_Babel(t *testing.T) {
+	t.Run("exactly N bytes", func(t *testing.T) {
+		b := Babel(NewNullReader(NullLength(5000), NullChunkSize(1000)))
+		n, err := io.Copy(io.Discard, b)
+		if err != nil {
+			t.Error(err)
+		}
+		if n != 5000 {
+			t.Errorf("expecting %v, got %v", 5000, n)
+		}
+	})
+
+	t.Run("conn closes at end", func(t *testing.T) {
+		b := Babel(NewNullReader(NullLength(10), NullCloseAtEnd()))
+		_, _ = b.Read(make([]byte, 10))
+		_, err := b.Read(make([]byte, 10))
+		if err != io.ErrClosedPipe {
+			t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+		}
+		_, err = b.Write(make([]byte, 10))
+		if err != io.ErrClosedPipe {
+			t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+		}
+	})
+
+	t.Run("close while blocked in slow source", func(t *testing.T) {
+		b := Babel(NewNullReader(NullRate(1), NullChunkSize(10)))
+		done := make(chan error)
+		go func() {
+			_, err := b.Read(make([]byte, 10))
+			done <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		_ = b.Close()
+		select {
+		case err := <-done:
+			if err != io.ErrClosedPipe {
+				t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Read did not unblock after Close")
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package connutil
+
+import (
+	"net"
+	"time"
+)
+
+// PipeOption configures the pipes created by NewPipe, NewPacketPipe, AsyncPipe, LimitedAsyncPipe, AsyncPacketPipe,
+// LimitedAsyncPacketPipe and the PipeDialer returned by DialerListener.
+//
+// Options about how data flows, such as WithBufferSizeLimit, apply to both directions of a pipe, unless wrapped by AtoB
+// or BtoA.
+type PipeOption func(*pipeConfig)
+
+const (
+	// directions of a pipe, indexing pipeConfig.dirs
+	dirAtoB = iota
+	dirBtoA
+)
+
+type pipeConfig struct {
+	hooks       *Hooks
+	tracker     *Tracker
+	idleTimeout time.Duration
+
+	dirs [2]directionConfig
+	// scope is the directions that direction options apply to, nil means both
+	scope []int
+}
+
+// directionConfig is the configuration of one direction of a pipe. addr and name belong to the writing end.
+type directionConfig struct {
+	bufferLimit int
+	addr        net.Addr
+	name        string
+
+	// stream pipes only
+	segmentSize   int
+	segmentRand   bool
+	segmentSeed   uint64
+	lowWater      int
+	coalesceDelay time.Duration
+	strict        bool
+	rcvWindow     int
+
+	// packet pipes only
+	mtu      int
+	truncate bool
+	lossy    bool
+}
+
+// localAddr returns the address of the writing end
+func (dir *directionConfig) localAddr() net.Addr {
+	return dir.localAddrOr(fakeAddr{})
+}
+
+// localAddrOr returns the address of the writing end, or def if there isn't one
+func (dir *directionConfig) localAddrOr(def net.Addr) net.Addr {
+	if dir.addr == nil {
+		return def
+	}
+	return dir.addr
+}
+
+// nameOr returns the name of the writing end, or the string form of id if there isn't one
+func (dir *directionConfig) nameOr(id ConnID) string {
+	if dir.name == "" {
+		return id.String()
+	}
+	return dir.name
+}
+
+func newPipeConfig(opts []PipeOption) *pipeConfig {
+	config := &pipeConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+// eachDirection calls f with the configuration of every direction in scope
+func (config *pipeConfig) eachDirection(f func(*directionConfig)) {
+	if config.scope == nil {
+		f(&config.dirs[dirAtoB])
+		f(&config.dirs[dirBtoA])
+		return
+	}
+	for _, dir := range config.scope {
+		f(&config.dirs[dir])
+	}
+}
+
+func scoped(dir int, opts []PipeOption) PipeOption {
+	return func(config *pipeConfig) {
+		scope := config.scope
+		config.scope = []int{dir}
+		for _, opt := range opts {
+			opt(config)
+		}
+		config.scope = scope
+	}
+}
+
+// AtoB applies opts only to the direction from the first end returned by the constructor to the second end. For
+// DialerListener, that is the direction from the dialer's end to the listener's end, i.e. upload.
+//
+// For example, LimitedAsyncPipe(1<<20, AtoB(WithBufferSizeLimit(1024))) creates a pipe with a small upload buffer and
+// a big download buffer. Options not about a direction, such as WithHooks, apply to the whole pipe regardless.
+func AtoB(opts ...PipeOption) PipeOption {
+	return scoped(dirAtoB, opts)
+}
+
+// BtoA applies opts only to the direction from the second end returned by the constructor to the first end. For
+// DialerListener, that is the direction from the listener's end to the dialer's end, i.e. download.
+func BtoA(opts ...PipeOption) PipeOption {
+	return scoped(dirBtoA, opts)
+}
+
+// WithBufferSizeLimit limits the size of the buffer, as the bufferSizeLimit argument of LimitedAsyncPipe and
+// LimitedAsyncPacketPipe does. Default (0) means unlimited.
+func WithBufferSizeLimit(n int) PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) { dir.bufferLimit = n })
+	}
+}
+
+// WithAddr sets the address of the writing end: its LocalAddr, and the RemoteAddr of the other end. Use it within AtoB
+// or BtoA to give the two ends different addresses. Default is a meaningless mock address for stream pipes, and a
+// *net.UDPAddr unique to each end for packet pipes.
+func WithAddr(addr net.Addr) PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) { dir.addr = addr })
+	}
+}
+
+// WithName sets the debug name of the writing end, as returned by its Name method and shown in leak reports. Use it
+// within AtoB or BtoA to give the two ends different names.
+func WithName(name string) PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) { dir.name = name })
+	}
+}
+
+// WithHooks sets the callbacks invoked on operations on the pipes.
+func WithHooks(hooks *Hooks) PipeOption {
+	return func(config *pipeConfig) {
+		config.hooks = hooks
+	}
+}
+
+// WithMTU limits the size of datagrams on packet pipes. Writing a datagram larger than mtu fails with a *net.OpError
+// wrapping syscall.EMSGSIZE, like writing to a UDP socket does. Default (0) means no limit other than the buffer size
+// limit.
+//
+// Stream pipes ignore this option.
+func WithMTU(mtu int) PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) { dir.mtu = mtu })
+	}
+}
+
+// WithTruncation makes packet pipes behave like UDP sockets when the reader's buffer is too small for a datagram:
+// the datagram is truncated to the size of the buffer and the rest of it is discarded. Use PacketPipe.ReadPacket to
+// find out whether a datagram is truncated.
+//
+// By default, such reads fail with io.ErrShortBuffer and the datagram is left in the pipe.
+//
+// Stream pipes ignore this option.
+func WithTruncation() PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) { dir.truncate = true })
+	}
+}
+
+// WithLossy makes packet pipes behave like UDP sockets when the buffer is full: instead of blocking, Write succeeds
+// immediately and the datagram is silently dropped. A datagram is still accepted as long as the buffered size doesn't
+// exceed the buffer size limit.
+//
+// A datagram larger than the buffer size limit is also silently dropped, and Write reports success instead of
+// returning ErrWriteToLarge. Dropped datagrams are counted in Stats().Sent.Dropped of the writing end and
+// Stats().Received.Dropped of the other end.
+//
+// It has no effect without a buffer size limit. Stream pipes ignore this option.
+func WithLossy() PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) { dir.lossy = true })
+	}
+}
+
+// WithTracker registers the pipes created with tr, so that tr.Check reports the ones never closed.
+func WithTracker(tr *Tracker) PipeOption {
+	return func(config *pipeConfig) {
+		config.tracker = tr
+	}
+}
+
+// WithSegmentSize makes each Read on stream pipes return at most n bytes, as if the data is delivered in segments of
+// n bytes like TCP does with its MSS. WithSegmentSize(1) delivers data one byte at a time, which exercises every
+// possible partial read.
+//
+// Packet pipes ignore this option.
+func WithSegmentSize(n int) PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) {
+			dir.segmentSize = n
+			dir.segmentRand = false
+		})
+	}
+}
+
+// WithRandomSegments makes each Read on stream pipes return at most a random number of bytes between 1 and maxSize.
+// The sizes are drawn from a PRNG seeded with seed, so that the same sequence of Read calls splits data in the same
+// way every time.
+//
+// Packet pipes ignore this option.
+func WithRandomSegments(seed uint64, maxSize int) PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) {
+			dir.segmentSize = maxSize
+			dir.segmentRand = true
+			dir.segmentSeed = seed
+		})
+	}
+}
+
+// WithCoalescing makes Read on stream pipes wait until at least minBytes are available, or as much as the buffer
+// given to Read can hold if it is smaller, so that several small writes are delivered by one Read, like Nagle's
+// algorithm does. Data is only delayed, never withheld: Read returns with whatever is available once maxDelay has
+// passed since the first byte of it is written. Default (0) maxDelay means DefaultCoalescingDelay. Read also returns
+// with less data after the writer has shut down, the pipe is closed, or the read deadline is reached with some data
+// available.
+//
+// Packet pipes ignore this option.
+func WithCoalescing(minBytes int, maxDelay time.Duration) PipeOption {
+	if maxDelay == 0 {
+		maxDelay = DefaultCoalescingDelay
+	}
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) {
+			dir.lowWater = minBytes
+			dir.coalesceDelay = maxDelay
+		})
+	}
+}
+
+// DefaultCoalescingDelay is the longest WithCoalescing delays data by default, which is the same as the limit of
+// TCP_CORK on Linux
+const DefaultCoalescingDelay = 200 * time.Millisecond
+
+// WithStrictLimit makes the buffer size limit of LimitedAsyncPipe a hard capacity, like the send buffer of a TCP
+// socket. Data written is accepted incrementally as the reader drains the buffer, so the buffer never grows beyond the
+// limit. If the write deadline is reached or the pipe is closed in the middle of a Write, the number of bytes already
+// accepted is returned along with the error, as *net.TCPConn does.
+//
+// By default, the limit is a soft one: Write blocks until the buffer size is no larger than the limit, then appends
+// the whole of its data at once.
+//
+// Packet pipes ignore this option.
+func WithStrictLimit() PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) { dir.strict = true })
+	}
+}
+
+// WithReceiveWindow gives each direction of stream pipes a receive buffer of size bytes, separate from the send buffer
+// whose size is the buffer size limit of LimitedAsyncPipe. Data written goes to the send buffer first, and moves to the
+// receive buffer as the receive window allows. When the reader stops reading, the receive buffer fills up and the
+// window closes, data piles up in the send buffer, and eventually Write blocks, as in a TCP zero-window stall.
+// Every time the window closes is counted in DirectionStats.ZeroWindows.
+//
+// StreamPipe.SetReadBuffer and StreamPipe.SetWriteBuffer change the sizes at runtime.
+//
+// Packet pipes ignore this option.
+func WithReceiveWindow(size int) PipeOption {
+	return func(config *pipeConfig) {
+		config.eachDirection(func(dir *directionConfig) { dir.rcvWindow = size })
+	}
+}
+
+// WithIdleTimeout closes pipes after no data has been written or read in either direction for timeout, like an idle
+// connection dropped by a NAT or a load balancer. I/O on both ends fails with io.ErrClosedPipe afterwards.
+func WithIdleTimeout(timeout time.Duration) PipeOption {
+	return func(config *pipeConfig) {
+		config.idleTimeout = timeout
+	}
+}
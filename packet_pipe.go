@@ -1,7 +1,11 @@
 package connutil
 
 import (
+	"context"
 	"net"
+	"net/netip"
+	"os"
+	"syscall"
 	"time"
 )
 
@@ -10,54 +14,128 @@ import (
 type PacketPipe struct {
 	writeEnd *bufferedPacketPipe
 	readEnd  *bufferedPacketPipe
+
+	id    ConnID
+	name  string
+	hooks *Hooks
+
+	localAddr, remoteAddr net.Addr
 }
 
+// ID returns the identity of this end of the pipe, as reported to Hooks
+func (conn *PacketPipe) ID() ConnID { return conn.id }
+
+// Name returns the name of this end of the pipe set through WithName, or the string form of its ID if there isn't one.
+func (conn *PacketPipe) Name() string { return conn.name }
+
 // ReadFrom implements the net.PacketConn ReadFrom method. It behaves in the same way as Read.
-// The returned addr is not null but serves no purpose.
+// The returned addr is the LocalAddr of the writer, which is also the RemoteAddr of this end.
 func (conn *PacketPipe) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, err = conn.Read(p)
-	addr = conn.RemoteAddr()
+	n, _, _, addr, err = conn.readEnd.ReadMsg(p, nil)
 	return
 }
 
 // WriteTo implements the net.PacketConn WriteTo method. It behaves in the same way as Write.
-// The addr argument is discarded.
+// As a pipe only has one destination, addr is ignored. The reader sees the LocalAddr of this end as the source address.
 func (conn *PacketPipe) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	n, err = conn.Write(p)
+	n, _, err = conn.writeMsg(context.Background(), p, nil)
 	return
 }
 
 // Read reads a packet from the pipe into p. Read calls will block until data becomes available by writing to the other end.
-// If the len(p) is smaller than the size of the packet, nothing will be read and err will be io.ShortBuffer.
+// If the len(p) is smaller than the size of the packet, nothing will be read and err will be io.ShortBuffer, unless
+// the pipe is created with WithTruncation.
 func (conn *PacketPipe) Read(p []byte) (n int, err error) {
 	n, err = conn.readEnd.Read(p)
 	return n, err
 }
 
+// ReadContext behaves like Read, but returns ctx.Err() once ctx is done. Unlike SetReadDeadline, it doesn't affect
+// other Read calls.
+func (conn *PacketPipe) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	n, _, _, _, err = conn.readEnd.ReadMsgContext(ctx, p, nil)
+	return
+}
+
+// WriteContext behaves like Write, but returns ctx.Err() once ctx is done. Unlike SetWriteDeadline, it doesn't affect
+// other Write calls.
+func (conn *PacketPipe) WriteContext(ctx context.Context, p []byte) (n int, err error) {
+	n, _, err = conn.writeMsg(ctx, p, nil)
+	return
+}
+
+// ReadPacket behaves in the same way as Read, but also reports whether the packet is truncated because len(p) is
+// smaller than the size of the packet. Packets can only be truncated if the pipe is created with WithTruncation.
+func (conn *PacketPipe) ReadPacket(p []byte) (n int, truncated bool, err error) {
+	n, _, flags, _, err := conn.readEnd.ReadMsg(p, nil)
+	return n, flags&msgTrunc != 0, err
+}
+
 // Write writes a packet from p to the pipe. If a buffer size is specified using LimitedAsyncPacketPipe, it may block
-// until data is read from the other end.
-// If len(p) is larger than the buffer size, err will be ErrWriteToLarge.
+// until data is read from the other end, unless the pipe is created with WithLossy, in which case the packet is dropped.
+// If len(p) is larger than the buffer size, err will be ErrWriteToLarge. If len(p) is larger than the MTU set through
+// WithMTU, err will be a *net.OpError wrapping syscall.EMSGSIZE.
 func (conn *PacketPipe) Write(p []byte) (n int, err error) {
-	n, err = conn.writeEnd.Write(p)
+	n, _, err = conn.writeMsg(context.Background(), p, nil)
 	return
 }
 
+// writeMsg writes a packet with the LocalAddr of this end as its source address
+func (conn *PacketPipe) writeMsg(ctx context.Context, p, oob []byte) (n, oobn int, err error) {
+	n, err = conn.writeEnd.WriteMsgContext(ctx, p, oob, conn.LocalAddr())
+	if err == syscall.EMSGSIZE {
+		err = &net.OpError{
+			Op:     "write",
+			Net:    conn.LocalAddr().Network(),
+			Source: conn.LocalAddr(),
+			Addr:   conn.RemoteAddr(),
+			Err:    os.NewSyscallError("write", err),
+		}
+	}
+	if err != nil {
+		return n, 0, err
+	}
+	return n, len(oob), nil
+}
+
 // Close closes the pipe. Calling Close on either end of a pipe will close both ends.
 func (conn *PacketPipe) Close() error {
 	conn.writeEnd.Close()
 	conn.readEnd.Close()
+	conn.hooks.fire(HookEvent{Op: HookClose, Conn: conn.id})
 	return nil
 }
 
+// setFrozen freezes or unfreezes both directions of the pipe
+func (conn *PacketPipe) setFrozen(frozen bool) {
+	conn.writeEnd.SetFrozen(frozen)
+	conn.readEnd.SetFrozen(frozen)
+}
+
+// finished reports whether both directions of the pipe are closed
+func (conn *PacketPipe) finished() bool {
+	writeClosed, _ := conn.writeEnd.leakState()
+	readClosed, _ := conn.readEnd.leakState()
+	return writeClosed && readClosed
+}
+
+// closeWithError closes both directions of the pipe, such that I/O on both ends fails with err
+func (conn *PacketPipe) closeWithError(err error) {
+	conn.writeEnd.CloseWithError(err)
+	conn.readEnd.CloseWithError(err)
+}
+
 // SetReadDeadline implements net.Conn and net.PacketConn SetReadDeadline method.
 func (conn *PacketPipe) SetReadDeadline(t time.Time) error {
 	conn.readEnd.SetReadDeadline(t)
+	conn.hooks.fire(HookEvent{Op: HookSetReadDeadline, Conn: conn.id, Deadline: t})
 	return nil
 }
 
 // SetWriteDeadline implements net.Conn and net.PacketConn SetWriteDeadline method.
 func (conn *PacketPipe) SetWriteDeadline(t time.Time) error {
 	conn.writeEnd.SetWriteDeadline(t)
+	conn.hooks.fire(HookEvent{Op: HookSetWriteDeadline, Conn: conn.id, Deadline: t})
 	return nil
 }
 
@@ -68,33 +146,153 @@ func (conn *PacketPipe) SetDeadline(t time.Time) error {
 	return nil
 }
 
-// LocalAddr implements net.Conn and net.PacketConn LocalAddr method. It returns a meaningless mock address.
-func (conn *PacketPipe) LocalAddr() net.Addr { return fakeAddr{} }
+// Stats returns the traffic statistics of this end of the pipe.
+func (conn *PacketPipe) Stats() Stats {
+	return Stats{
+		Sent:     conn.writeEnd.Stats(),
+		Received: conn.readEnd.Stats(),
+	}
+}
 
-// RemoteAddr implements net.Conn and net.PacketConn RemoteAddr method. It returns a meaningless mock address.
-func (conn *PacketPipe) RemoteAddr() net.Addr { return fakeAddr{} }
+// LocalAddr implements net.Conn and net.PacketConn LocalAddr method. It returns the address set through WithAddr, or a
+// *net.UDPAddr on the loopback network unique to this end if there isn't one.
+func (conn *PacketPipe) LocalAddr() net.Addr { return conn.localAddr }
+
+// RemoteAddr implements net.Conn and net.PacketConn RemoteAddr method. It returns the LocalAddr of the other end.
+func (conn *PacketPipe) RemoteAddr() net.Addr { return conn.remoteAddr }
 
 // AsyncPipe creates an in-memory, full-duplex, packet-oriented pipe with both ends implementing net.Conn and net.PacketConn
 // interfaces. It is a drop-in replacement of net.Pipe, but creates a packet-oriented pipe instead.
 //
 // It is buffered, asynchronous and safe for concurrent use.
-func AsyncPacketPipe() (*PacketPipe, *PacketPipe) {
-	return LimitedAsyncPacketPipe(0)
+func AsyncPacketPipe(opts ...PipeOption) (*PacketPipe, *PacketPipe) {
+	return NewPacketPipe(opts...)
 }
 
 // LimitedAsyncPipe is similar to AsyncPipe, but limits the size of the underlying buffer.
 // Write calls will block if the buffer size grows larger than
 // bufferSizeLimit. Consuming data through Read calls on the other end will unblock the Write call.
-func LimitedAsyncPacketPipe(bufferSizeLimit int) (*PacketPipe, *PacketPipe) {
-	LtoR := newBufferedPacketPipe(bufferSizeLimit)
-	RtoL := newBufferedPacketPipe(bufferSizeLimit)
+//
+// It is a shorthand for NewPacketPipe with WithBufferSizeLimit(bufferSizeLimit) in front of opts.
+func LimitedAsyncPacketPipe(bufferSizeLimit int, opts ...PipeOption) (*PacketPipe, *PacketPipe) {
+	return NewPacketPipe(append([]PipeOption{WithBufferSizeLimit(bufferSizeLimit)}, opts...)...)
+}
+
+// NewPacketPipe creates an in-memory, full-duplex, packet-oriented pipe with both ends implementing net.Conn and
+// net.PacketConn interfaces, configured by opts. Without any option, it is the same as AsyncPacketPipe.
+//
+// Each direction of the pipe can be configured independently by wrapping options in AtoB or BtoA, see NewPipe.
+func NewPacketPipe(opts ...PipeOption) (*PacketPipe, *PacketPipe) {
+	config := newPipeConfig(opts)
+	pipeID := nextPipeID()
+	aID := ConnID{Pipe: pipeID, End: 0}
+	bID := aID.peer()
+
+	LtoR := newBufferedPacketPipe(config.dirs[dirAtoB].bufferLimit)
+	LtoR.hooks, LtoR.writer, LtoR.reader = config.hooks, aID, bID
+	RtoL := newBufferedPacketPipe(config.dirs[dirBtoA].bufferLimit)
+	RtoL.hooks, RtoL.writer, RtoL.reader = config.hooks, bID, aID
+	for i, p := range []*bufferedPacketPipe{LtoR, RtoL} {
+		p.mtu, p.truncate, p.lossy = config.dirs[i].mtu, config.dirs[i].truncate, config.dirs[i].lossy
+	}
+	aAddr := config.dirs[dirAtoB].localAddrOr(defaultPacketAddr(aID))
+	bAddr := config.dirs[dirBtoA].localAddrOr(defaultPacketAddr(bID))
 	a := &PacketPipe{
-		writeEnd: LtoR,
-		readEnd:  RtoL,
+		writeEnd:   LtoR,
+		readEnd:    RtoL,
+		id:         aID,
+		name:       config.dirs[dirAtoB].nameOr(aID),
+		hooks:      config.hooks,
+		localAddr:  aAddr,
+		remoteAddr: bAddr,
 	}
 	b := &PacketPipe{
-		writeEnd: RtoL,
-		readEnd:  LtoR,
+		writeEnd:   RtoL,
+		readEnd:    LtoR,
+		id:         bID,
+		name:       config.dirs[dirBtoA].nameOr(bID),
+		hooks:      config.hooks,
+		localAddr:  bAddr,
+		remoteAddr: aAddr,
 	}
+	if config.idleTimeout > 0 {
+		watchIdle(config.idleTimeout, func() { _ = a.Close() }, LtoR, RtoL)
+	}
+	trackPipe(config, "PacketPipe", pipeID, LtoR, RtoL)
 	return a, b
 }
+
+// defaultPacketAddr returns a loopback address unique to the end id, so that a reader can tell the writers of different
+// pipes apart, as a UDP server tells its clients apart. Addresses repeat after 2^24 pipes.
+func defaultPacketAddr(id ConnID) net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, byte(id.Pipe>>16), byte(id.Pipe>>8), byte(id.Pipe)), Port: 49152 + id.End}
+}
+
+// The methods below mirror those of *net.UDPConn, so that code written against it can run over a PacketPipe.
+// Out-of-band data written through WriteMsgUDP is delivered as is to ReadMsgUDP on the other end.
+//
+// As a pipe only has one destination, the destination address given to the write methods is ignored. The source
+// address of a packet is the LocalAddr of the writer. It is only reported as a *net.UDPAddr or a netip.AddrPort if it
+// is one, which is the case unless a different type of address is set through WithAddr. Otherwise, the returned
+// address is nil or the zero netip.AddrPort.
+
+func toUDPAddr(addr net.Addr) *net.UDPAddr {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr
+	}
+	return nil
+}
+
+func toAddrPort(addr net.Addr) netip.AddrPort {
+	if udpAddr := toUDPAddr(addr); udpAddr != nil {
+		return udpAddr.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
+// ReadMsgUDP mirrors the *net.UDPConn ReadMsgUDP method. flags has syscall.MSG_TRUNC set if the packet is truncated,
+// and syscall.MSG_CTRUNC set if the out-of-band data is truncated to fit into oob.
+func (conn *PacketPipe) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	n, oobn, flags, src, err := conn.readEnd.ReadMsg(b, oob)
+	return n, oobn, flags, toUDPAddr(src), err
+}
+
+// ReadMsgUDPAddrPort mirrors the *net.UDPConn ReadMsgUDPAddrPort method.
+func (conn *PacketPipe) ReadMsgUDPAddrPort(b, oob []byte) (n, oobn, flags int, addr netip.AddrPort, err error) {
+	n, oobn, flags, src, err := conn.readEnd.ReadMsg(b, oob)
+	return n, oobn, flags, toAddrPort(src), err
+}
+
+// ReadFromUDP mirrors the *net.UDPConn ReadFromUDP method.
+func (conn *PacketPipe) ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error) {
+	n, _, _, src, err := conn.readEnd.ReadMsg(b, nil)
+	return n, toUDPAddr(src), err
+}
+
+// ReadFromUDPAddrPort mirrors the *net.UDPConn ReadFromUDPAddrPort method.
+func (conn *PacketPipe) ReadFromUDPAddrPort(b []byte) (n int, addr netip.AddrPort, err error) {
+	n, _, _, src, err := conn.readEnd.ReadMsg(b, nil)
+	return n, toAddrPort(src), err
+}
+
+// WriteMsgUDP mirrors the *net.UDPConn WriteMsgUDP method. Like WriteTo, addr is ignored.
+func (conn *PacketPipe) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	return conn.writeMsg(context.Background(), b, oob)
+}
+
+// WriteMsgUDPAddrPort mirrors the *net.UDPConn WriteMsgUDPAddrPort method.
+func (conn *PacketPipe) WriteMsgUDPAddrPort(b, oob []byte, addr netip.AddrPort) (n, oobn int, err error) {
+	return conn.writeMsg(context.Background(), b, oob)
+}
+
+// WriteToUDP mirrors the *net.UDPConn WriteToUDP method.
+func (conn *PacketPipe) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	n, _, err := conn.writeMsg(context.Background(), b, nil)
+	return n, err
+}
+
+// WriteToUDPAddrPort mirrors the *net.UDPConn WriteToUDPAddrPort method.
+func (conn *PacketPipe) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	n, _, err := conn.writeMsg(context.Background(), b, nil)
+	return n, err
+}
@@ -2,9 +2,12 @@ package connutil
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"math/rand"
+	"net"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -242,3 +245,259 @@ func TestLimitedAsyncPacketPipe(t *testing.T) {
 		}
 	})
 }
+
+func TestPacketPipe_MTU(t *testing.T) {
+	w, r := AsyncPacketPipe(WithMTU(1200))
+	_, err := w.Write(make([]byte, 1201))
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || !errors.Is(err, syscall.EMSGSIZE) {
+		t.Errorf("expecting *net.OpError wrapping %v, got %v", syscall.EMSGSIZE, err)
+	}
+	if _, err = w.Write(make([]byte, 1200)); err != nil {
+		t.Error(err)
+	}
+	if n, _ := r.Read(make([]byte, 1500)); n != 1200 {
+		t.Errorf("expecting a 1200 byte datagram, got %v bytes", n)
+	}
+}
+
+func TestPacketPipe_Truncation(t *testing.T) {
+	testData := []byte("0123456789")
+	t.Run("default", func(t *testing.T) {
+		w, r := AsyncPacketPipe()
+		_, _ = w.Write(testData)
+		n, truncated, err := r.ReadPacket(make([]byte, 4))
+		if n != 0 || truncated || err != io.ErrShortBuffer {
+			t.Errorf("expecting 0, false, %v, got %v, %v, %v", io.ErrShortBuffer, n, truncated, err)
+		}
+	})
+	t.Run("truncate", func(t *testing.T) {
+		w, r := AsyncPacketPipe(WithTruncation())
+		_, _ = w.Write(testData)
+		_, _ = w.Write([]byte("next"))
+
+		recvBuf := make([]byte, 4)
+		n, truncated, err := r.ReadPacket(recvBuf)
+		if err != nil {
+			t.Error(err)
+		}
+		if n != 4 || !truncated || string(recvBuf) != "0123" {
+			t.Errorf("expecting truncated 0123, got %q (truncated: %v)", recvBuf[:n], truncated)
+		}
+
+		// the rest of the datagram is discarded
+		n, err = r.Read(recvBuf)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(recvBuf[:n]) != "next" {
+			t.Errorf("expecting next, got %q", recvBuf[:n])
+		}
+	})
+}
+
+func TestPacketPipe_UDPMethods(t *testing.T) {
+	dst := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4433}
+	t.Run("msg", func(t *testing.T) {
+		w, r := AsyncPacketPipe()
+		n, oobn, err := w.WriteMsgUDP([]byte("hello"), []byte{1, 2, 3}, dst)
+		if err != nil {
+			t.Error(err)
+		}
+		if n != 5 || oobn != 3 {
+			t.Errorf("expecting 5 and 3 bytes written, got %v and %v", n, oobn)
+		}
+
+		b, oob := make([]byte, 16), make([]byte, 16)
+		n, oobn, flags, addr, err := r.ReadMsgUDP(b, oob)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(b[:n]) != "hello" || !bytes.Equal(oob[:oobn], []byte{1, 2, 3}) || flags != 0 {
+			t.Errorf("unexpected message %q, oob %v, flags %v", b[:n], oob[:oobn], flags)
+		}
+		if addr.String() != w.LocalAddr().String() {
+			t.Errorf("expecting source %v, got %v", w.LocalAddr(), addr)
+		}
+	})
+	t.Run("truncated msg", func(t *testing.T) {
+		w, r := AsyncPacketPipe(WithTruncation())
+		_, _, _ = w.WriteMsgUDPAddrPort([]byte("hello"), []byte{1, 2, 3}, dst.AddrPort())
+		n, oobn, flags, addr, err := r.ReadMsgUDPAddrPort(make([]byte, 2), make([]byte, 1))
+		if err != nil {
+			t.Error(err)
+		}
+		if n != 2 || oobn != 1 {
+			t.Errorf("expecting 2 and 1 bytes read, got %v and %v", n, oobn)
+		}
+		if flags&msgTrunc == 0 || flags&msgCtrunc == 0 {
+			t.Errorf("expecting MSG_TRUNC and MSG_CTRUNC in flags, got %#x", flags)
+		}
+		if src := w.LocalAddr().(*net.UDPAddr).AddrPort(); addr != src {
+			t.Errorf("expecting source %v, got %v", src, addr)
+		}
+	})
+	t.Run("to and from", func(t *testing.T) {
+		w, r := AsyncPacketPipe()
+		_, _ = w.WriteToUDP([]byte("hello"), dst)
+		_, _ = w.WriteToUDPAddrPort([]byte("hello"), dst.AddrPort())
+		_, _ = w.Write([]byte("hello"))
+
+		b := make([]byte, 16)
+		src := w.LocalAddr().(*net.UDPAddr)
+		_, addr, err := r.ReadFromUDP(b)
+		if err != nil || addr.String() != src.String() {
+			t.Errorf("expecting source %v, got %v, %v", src, addr, err)
+		}
+		_, addrPort, err := r.ReadFromUDPAddrPort(b)
+		if err != nil || addrPort != src.AddrPort() {
+			t.Errorf("expecting source %v, got %v, %v", src.AddrPort(), addrPort, err)
+		}
+		// written without a destination
+		_, addr, err = r.ReadFromUDP(b)
+		if err != nil || addr.String() != src.String() {
+			t.Errorf("expecting source %v, got %v, %v", src, addr, err)
+		}
+	})
+	t.Run("not a UDP address", func(t *testing.T) {
+		w, r := AsyncPacketPipe(WithAddr(fakeAddr{}))
+		_, _ = w.Write([]byte("hello"))
+		_, addr, err := r.ReadFromUDP(make([]byte, 16))
+		if err != nil || addr != nil {
+			t.Errorf("expecting nil source, got %v, %v", addr, err)
+		}
+	})
+	t.Run("telling clients apart", func(t *testing.T) {
+		d, l := DialerListener(2)
+		clients := make([]net.Conn, 2)
+		servers := make([]net.PacketConn, 2)
+		for i := range clients {
+			clients[i], _ = d.Dial("udp", "")
+			servers[i], _ = l.ListenPacket("udp", "")
+		}
+		b := make([]byte, 16)
+		sources := make(map[string]int)
+		for i, server := range servers {
+			_, _ = clients[i].Write([]byte{byte(i)})
+			n, addr, err := server.ReadFrom(b)
+			if err != nil || n != 1 {
+				t.Fatalf("expecting 1 byte and no error, got %v and %v", n, err)
+			}
+			if addr.String() != clients[i].LocalAddr().String() {
+				t.Errorf("expecting source %v, got %v", clients[i].LocalAddr(), addr)
+			}
+			sources[addr.String()] = int(b[0])
+			// reply to the address read from
+			_, _ = server.WriteTo([]byte{b[0]}, addr)
+		}
+		if len(sources) != len(clients) {
+			t.Errorf("expecting %v distinct sources, got %v", len(clients), sources)
+		}
+		for i, client := range clients {
+			n, addr, err := client.(*PacketPipe).ReadFrom(b)
+			if err != nil || n != 1 || b[0] != byte(i) {
+				t.Errorf("expecting reply %v, got %v and %v", i, b[:n], err)
+			}
+			if addr.String() != servers[i].LocalAddr().String() || addr.String() == client.LocalAddr().String() {
+				t.Errorf("expecting source %v, got %v", servers[i].LocalAddr(), addr)
+			}
+		}
+	})
+}
+
+func TestNewPacketPipe(t *testing.T) {
+	t.Run("asymmetric MTU", func(t *testing.T) {
+		a, b := NewPacketPipe(AtoB(WithMTU(100)), BtoA(WithMTU(1500)))
+		if _, err := a.Write(make([]byte, 1000)); !errors.Is(err, syscall.EMSGSIZE) {
+			t.Errorf("expecting %v, got %v", syscall.EMSGSIZE, err)
+		}
+		if _, err := b.Write(make([]byte, 1000)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("asymmetric buffers", func(t *testing.T) {
+		a, b := NewPacketPipe(AtoB(WithBufferSizeLimit(100)))
+		if _, err := a.Write(make([]byte, 1000)); err != ErrWriteToLarge {
+			t.Errorf("expecting %v, got %v", ErrWriteToLarge, err)
+		}
+		if _, err := b.Write(make([]byte, 1000)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("addresses", func(t *testing.T) {
+		client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+		server := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}
+		a, b := NewPacketPipe(AtoB(WithAddr(client)), BtoA(WithAddr(server)))
+		if a.RemoteAddr() != server || b.RemoteAddr() != client {
+			t.Errorf("expecting %v and %v, got %v and %v", server, client, a.RemoteAddr(), b.RemoteAddr())
+		}
+		_, _ = a.Write([]byte("hello"))
+		_, addr, err := b.ReadFromUDP(make([]byte, 5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != client {
+			t.Errorf("expecting %v, got %v", client, addr)
+		}
+	})
+}
+
+func TestPacketPipe_Lossy(t *testing.T) {
+	t.Run("drop when full", func(t *testing.T) {
+		a, b := LimitedAsyncPacketPipe(100, WithLossy())
+		for i := 0; i < 5; i++ {
+			n, err := a.Write(make([]byte, 60))
+			if err != nil || n != 60 {
+				t.Errorf("expecting 60 bytes and no error, got %v and %v", n, err)
+			}
+		}
+		// the first two packets are accepted as the buffered size was within the limit before each of them
+		if dropped := a.Stats().Sent.Dropped; dropped != 3 {
+			t.Errorf("expecting %v, got %v", 3, dropped)
+		}
+		if dropped := b.Stats().Received.Dropped; dropped != 3 {
+			t.Errorf("expecting %v, got %v", 3, dropped)
+		}
+		if written := a.Stats().Sent.PacketsWritten; written != 2 {
+			t.Errorf("expecting %v, got %v", 2, written)
+		}
+
+		_, _ = b.Read(make([]byte, 60))
+		_, _ = b.Read(make([]byte, 60))
+		if _, err := a.Write(make([]byte, 60)); err != nil {
+			t.Error(err)
+		}
+		if written := a.Stats().Sent.PacketsWritten; written != 3 {
+			t.Errorf("expecting %v, got %v", 3, written)
+		}
+	})
+
+	t.Run("oversized packet", func(t *testing.T) {
+		a, _ := LimitedAsyncPacketPipe(100, WithLossy())
+		n, err := a.Write(make([]byte, 1000))
+		if err != nil || n != 1000 {
+			t.Errorf("expecting 1000 bytes and no error, got %v and %v", n, err)
+		}
+		if dropped := a.Stats().Sent.Dropped; dropped != 1 {
+			t.Errorf("expecting %v, got %v", 1, dropped)
+		}
+	})
+
+	t.Run("one direction", func(t *testing.T) {
+		a, b := LimitedAsyncPacketPipe(100, BtoA(WithLossy()))
+		for i := 0; i < 3; i++ {
+			_, _ = b.Write(make([]byte, 60))
+		}
+		if dropped := b.Stats().Sent.Dropped; dropped != 1 {
+			t.Errorf("expecting %v, got %v", 1, dropped)
+		}
+		_, _ = a.Write(make([]byte, 60))
+		_, _ = a.Write(make([]byte, 60))
+		_ = a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err := a.Write(make([]byte, 60)); err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package connutil
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DialFailure specifies how dials fail during a network partition
+type DialFailure int
+
+const (
+	// DialHang makes dials block until the partition heals, the dial's context is done, or Partition.DialTimeout
+	// passes
+	DialHang DialFailure = iota
+	// DialRefuse makes dials fail immediately with ErrConnRefused
+	DialRefuse
+)
+
+// EstablishedFailure specifies what happens to established pipes during a network partition
+type EstablishedFailure int
+
+const (
+	// EstablishedUnaffected leaves established pipes working
+	EstablishedUnaffected EstablishedFailure = iota
+	// EstablishedFreeze stops delivering data on established pipes. Writes are still accepted until the buffer is full.
+	// The data is delivered once the partition heals.
+	EstablishedFreeze
+	// EstablishedKill resets all established pipes, making their I/O fail with ErrConnReset
+	EstablishedKill
+)
+
+// Partition describes a network partition between a PipeDialer and its PipeListener
+type Partition struct {
+	Dial DialFailure
+	// DialTimeout, if not zero, makes hanging dials fail with ErrTimeout after this duration
+	DialTimeout time.Duration
+	Established EstablishedFailure
+}
+
+type pipeEnd interface {
+	statser
+	setFrozen(bool)
+	closeWithError(error)
+	finished() bool
+}
+
+// PartitionController partitions and heals the in-memory network between a PipeDialer and its PipeListener.
+// It is obtained through PipeDialer.Controller or PipeListener.Controller.
+type PartitionController struct {
+	l *PipeListener
+
+	// protected by l.connsM
+	partition *Partition
+	healed    chan struct{}
+}
+
+// Controller returns the PartitionController of the network between d and its PipeListener
+func (d *PipeDialer) Controller() *PartitionController { return d.peer.controller }
+
+// Controller returns the PartitionController of the network between l and its PipeDialer
+func (l *PipeListener) Controller() *PartitionController { return l.controller }
+
+// Partition starts a network partition. If a partition is already in place, it is replaced by p, but pipes already
+// killed stay dead.
+func (c *PartitionController) Partition(p Partition) {
+	c.l.connsM.Lock()
+	defer c.l.connsM.Unlock()
+
+	if c.partition == nil {
+		c.healed = make(chan struct{})
+	}
+	c.partition = &p
+	for _, conn := range c.l.dialed {
+		c.apply(conn)
+	}
+}
+
+// apply must be called with c.l.connsM held
+func (c *PartitionController) apply(conn pipeEnd) {
+	switch {
+	case c.partition == nil:
+		conn.setFrozen(false)
+	case c.partition.Established == EstablishedFreeze:
+		conn.setFrozen(true)
+	case c.partition.Established == EstablishedKill:
+		conn.closeWithError(ErrConnReset)
+	default:
+		conn.setFrozen(false)
+	}
+}
+
+// Heal ends the network partition. Frozen pipes resume delivering data, and dials succeed again.
+func (c *PartitionController) Heal() {
+	c.l.connsM.Lock()
+	defer c.l.connsM.Unlock()
+
+	if c.partition == nil {
+		return
+	}
+	c.partition = nil
+	close(c.healed)
+	for _, conn := range c.l.dialed {
+		c.apply(conn)
+	}
+}
+
+// Partitioned reports whether the network is currently partitioned
+func (c *PartitionController) Partitioned() bool {
+	c.l.connsM.Lock()
+	defer c.l.connsM.Unlock()
+	return c.partition != nil
+}
+
+// Flap repeatedly partitions the network with p for down, then heals it for up, until stop is called.
+// The network is healed when Flap stops.
+func (c *PartitionController) Flap(p Partition, down, up time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer c.Heal()
+		for {
+			c.Partition(p)
+			select {
+			case <-done:
+				return
+			case <-time.After(down):
+			}
+			c.Heal()
+			select {
+			case <-done:
+				return
+			case <-time.After(up):
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// waitDial returns nil once a dial is allowed to go through the network
+func (c *PartitionController) waitDial(ctx context.Context) error {
+	c.l.connsM.Lock()
+	p := c.partition
+	healed := c.healed
+	c.l.connsM.Unlock()
+
+	if p == nil {
+		return nil
+	}
+	if p.Dial == DialRefuse {
+		return ErrConnRefused
+	}
+	var timeout <-chan time.Time
+	if p.DialTimeout != 0 {
+		timer := time.NewTimer(p.DialTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-healed:
+		// the network may have been partitioned again
+		return c.waitDial(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return ErrTimeout
+	}
+}
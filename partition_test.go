@@ -0,0 +1,120 @@
+package connutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPartitionController_Dial(t *testing.T) {
+	t.Run("refuse", func(t *testing.T) {
+		d, _ := DialerListener(1)
+		d.Controller().Partition(Partition{Dial: DialRefuse})
+		if _, err := d.Dial("tcp", ""); !errors.Is(err, ErrConnRefused) {
+			t.Errorf("expecting %v, got %v", ErrConnRefused, err)
+		}
+		d.Controller().Heal()
+		if _, err := d.Dial("tcp", ""); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("hang until timeout", func(t *testing.T) {
+		d, _ := DialerListener(1)
+		d.Controller().Partition(Partition{Dial: DialHang, DialTimeout: 100 * time.Millisecond})
+		if _, err := d.Dial("tcp", ""); err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		d.Controller().Partition(Partition{Dial: DialHang})
+		if _, err := d.DialContext(ctx, "udp", ""); err != context.DeadlineExceeded {
+			t.Errorf("expecting %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+	t.Run("hang until healed", func(t *testing.T) {
+		d, l := DialerListener(1)
+		d.Controller().Partition(Partition{Dial: DialHang})
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			l.Controller().Heal()
+		}()
+		if _, err := d.Dial("tcp", ""); err != nil {
+			t.Error(err)
+		}
+		if d.Controller().Partitioned() {
+			t.Error("network should have been healed")
+		}
+	})
+}
+
+func TestPartitionController_Established(t *testing.T) {
+	t.Run("freeze", func(t *testing.T) {
+		d, l := DialerListener(1)
+		a, _ := d.Dial("tcp", "")
+		b, _ := l.Accept()
+		d.Controller().Partition(Partition{Established: EstablishedFreeze})
+
+		_, err := a.Write([]byte("hello"))
+		if err != nil {
+			t.Error(err)
+		}
+		_ = b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err = b.Read(make([]byte, 5)); err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+
+		d.Controller().Heal()
+		_ = b.SetReadDeadline(time.Time{})
+		recvBuf := make([]byte, 5)
+		if _, err = io.ReadFull(b, recvBuf); err != nil {
+			t.Error(err)
+		}
+		if string(recvBuf) != "hello" {
+			t.Errorf("expecting hello, got %q", recvBuf)
+		}
+	})
+	t.Run("kill", func(t *testing.T) {
+		d, l := DialerListener(1)
+		a, _ := d.Dial("udp", "")
+		b, _ := l.ListenPacket("udp", "")
+		d.Controller().Partition(Partition{Established: EstablishedKill})
+		if _, err := a.Write([]byte("hello")); !errors.Is(err, ErrConnReset) {
+			t.Errorf("expecting %v, got %v", ErrConnReset, err)
+		}
+		if _, _, err := b.ReadFrom(make([]byte, 5)); !errors.Is(err, ErrConnReset) {
+			t.Errorf("expecting %v, got %v", ErrConnReset, err)
+		}
+	})
+}
+
+func TestPartitionController_Flap(t *testing.T) {
+	d, l := DialerListener(1)
+	a, _ := d.Dial("tcp", "")
+	b, _ := l.Accept()
+
+	stop := d.Controller().Flap(Partition{Dial: DialRefuse, Established: EstablishedFreeze}, 50*time.Millisecond, 50*time.Millisecond)
+	var sawDown, sawUp bool
+	for i := 0; i < 20; i++ {
+		if d.Controller().Partitioned() {
+			sawDown = true
+		} else {
+			sawUp = true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !sawDown || !sawUp {
+		t.Error("network did not flap")
+	}
+	stop()
+	if d.Controller().Partitioned() {
+		t.Error("network should be healed after flapping stops")
+	}
+
+	_, _ = a.Write([]byte("hello"))
+	_ = b.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, err := io.ReadFull(b, make([]byte, 5)); err != nil {
+		t.Error(err)
+	}
+}
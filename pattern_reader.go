@@ -0,0 +1,202 @@
+package connutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// PRNGReader is an infinite source of pseudorandom bytes. The same seed always produces the same stream, regardless
+// of how it is split across Read calls.
+type PRNGReader struct {
+	state uint64
+	block [8]byte
+	pos   int
+}
+
+// NewPRNGReader returns a PRNGReader producing the stream for seed
+func NewPRNGReader(seed uint64) *PRNGReader {
+	return &PRNGReader{state: seed, pos: 8}
+}
+
+// splitmix64, see https://prng.di.unimi.it/splitmix64.c
+func (r *PRNGReader) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (r *PRNGReader) nonBlocking() bool { return true }
+
+func (r *PRNGReader) Read(b []byte) (int, error) {
+	for i := range b {
+		if r.pos == len(r.block) {
+			binary.LittleEndian.PutUint64(r.block[:], r.next())
+			r.pos = 0
+		}
+		b[i] = r.block[r.pos]
+		r.pos++
+	}
+	return len(b), nil
+}
+
+// PatternReader is an infinite source repeating a pattern
+type PatternReader struct {
+	pattern []byte
+	pos     int
+}
+
+// NewPatternReader returns a PatternReader repeating pattern, which must not be empty
+func NewPatternReader(pattern []byte) *PatternReader {
+	return &PatternReader{pattern: append([]byte(nil), pattern...)}
+}
+
+func (r *PatternReader) nonBlocking() bool { return true }
+
+func (r *PatternReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = r.pattern[r.pos]
+		r.pos = (r.pos + 1) % len(r.pattern)
+	}
+	return len(b), nil
+}
+
+const (
+	chargenLineLen  = 72
+	chargenFirst    = ' '
+	chargenNumChars = '~' - ' ' + 1
+)
+
+// ChargenReader is an infinite source of the character generator protocol (RFC 864) stream: lines of 72 printable
+// ASCII characters ending with CRLF, each line starting one character after the previous one.
+type ChargenReader struct {
+	line int
+	col  int
+}
+
+// NewChargenReader returns a ChargenReader at the start of the stream
+func NewChargenReader() *ChargenReader {
+	return &ChargenReader{}
+}
+
+func (r *ChargenReader) Read(b []byte) (int, error) {
+	for i := range b {
+		switch {
+		case r.col < chargenLineLen:
+			b[i] = byte(chargenFirst + (r.line+r.col)%chargenNumChars)
+		case r.col == chargenLineLen:
+			b[i] = '\r'
+		default:
+			b[i] = '\n'
+		}
+		r.col++
+		if r.col == chargenLineLen+2 {
+			r.col = 0
+			r.line = (r.line + 1) % chargenNumChars
+		}
+	}
+	return len(b), nil
+}
+
+// CounterReader is an infinite source of consecutive 64-bit big-endian integers starting from 0. As every 8 bytes are
+// unique, it makes it easy to tell where misplaced data comes from.
+type CounterReader struct {
+	counter uint64
+	block   [8]byte
+	pos     int
+}
+
+// NewCounterReader returns a CounterReader starting from 0
+func NewCounterReader() *CounterReader {
+	return &CounterReader{}
+}
+
+func (r *CounterReader) Read(b []byte) (int, error) {
+	for i := range b {
+		if r.pos == 0 {
+			binary.BigEndian.PutUint64(r.block[:], r.counter)
+			r.counter++
+		}
+		b[i] = r.block[r.pos]
+		r.pos = (r.pos + 1) % len(r.block)
+	}
+	return len(b), nil
+}
+
+// MismatchError is returned by Verifier when the data written diverges from the expected stream
+type MismatchError struct {
+	// Offset is the position of the first diverging byte in the stream
+	Offset   int64
+	Expected byte
+	Got      byte
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("data diverges at offset %d: expected %#02x, got %#02x", e.Offset, e.Expected, e.Got)
+}
+
+// Verifier is an io.Writer that checks the data written to it against an expected stream, such as the one produced by
+// one of the readers in this package. This allows a known stream to be pushed through a conn, and proven to arrive
+// intact and in order.
+//
+// Once the data diverges, Write returns a *MismatchError, and all later Write calls return the same error.
+type Verifier struct {
+	expected io.Reader
+	offset   int64
+	err      error
+	buf      []byte
+}
+
+// NewVerifier returns a Verifier expecting the stream produced by expected
+func NewVerifier(expected io.Reader) *Verifier {
+	return &Verifier{expected: expected}
+}
+
+// NewPRNGVerifier returns a Verifier expecting the stream of NewPRNGReader(seed)
+func NewPRNGVerifier(seed uint64) *Verifier { return NewVerifier(NewPRNGReader(seed)) }
+
+// NewPatternVerifier returns a Verifier expecting the stream of NewPatternReader(pattern)
+func NewPatternVerifier(pattern []byte) *Verifier { return NewVerifier(NewPatternReader(pattern)) }
+
+// NewChargenVerifier returns a Verifier expecting the stream of NewChargenReader()
+func NewChargenVerifier() *Verifier { return NewVerifier(NewChargenReader()) }
+
+// NewCounterVerifier returns a Verifier expecting the stream of NewCounterReader()
+func NewCounterVerifier() *Verifier { return NewVerifier(NewCounterReader()) }
+
+func (v *Verifier) Write(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	if cap(v.buf) < len(p) {
+		v.buf = make([]byte, len(p))
+	}
+	expected := v.buf[:len(p)]
+	n, err := io.ReadFull(v.expected, expected)
+	for i := 0; i < n; i++ {
+		if p[i] != expected[i] {
+			v.err = &MismatchError{Offset: v.offset + int64(i), Expected: expected[i], Got: p[i]}
+			v.offset += int64(i)
+			return i, v.err
+		}
+	}
+	v.offset += int64(n)
+	if err != nil {
+		// more data than the expected stream has
+		v.err = fmt.Errorf("data exceeds the expected stream at offset %d: %w", v.offset, err)
+		return n, v.err
+	}
+	return n, nil
+}
+
+// Verified returns the number of bytes verified so far
+func (v *Verifier) Verified() int64 {
+	return v.offset
+}
+
+// Err returns the error that has stopped the verification, or nil if all data written so far is as expected
+func (v *Verifier) Err() error {
+	return v.err
+}
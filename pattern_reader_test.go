@@ -0,0 +1,127 @@
+package connutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPatternReaders_Deterministic(t *testing.T) {
+	sources := map[string]func() io.Reader{
+		"prng":    func() io.Reader { return NewPRNGReader(42) },
+		"pattern": func() io.Reader { return NewPatternReader([]byte("abcdefg")) },
+		"chargen": func() io.Reader { return NewChargenReader() },
+		"counter": func() io.Reader { return NewCounterReader() },
+	}
+	for name, newSource := range sources {
+		t.Run(name, func(t *testing.T) {
+			whole := make([]byte, 1000)
+			_, _ = io.ReadFull(newSource(), whole)
+
+			// reading in odd-sized chunks must produce the same stream
+			chunked := make([]byte, 0, len(whole))
+			r := newSource()
+			for len(chunked) < len(whole) {
+				chunk := make([]byte, 13)
+				if len(whole)-len(chunked) < len(chunk) {
+					chunk = chunk[:len(whole)-len(chunked)]
+				}
+				n, err := r.Read(chunk)
+				if err != nil {
+					t.Fatal(err)
+				}
+				chunked = append(chunked, chunk[:n]...)
+			}
+			if !bytes.Equal(whole, chunked) {
+				t.Error("stream depends on how it is read")
+			}
+		})
+	}
+}
+
+func TestPRNGReader_Seed(t *testing.T) {
+	a := make([]byte, 64)
+	b := make([]byte, 64)
+	_, _ = NewPRNGReader(1).Read(a)
+	_, _ = NewPRNGReader(2).Read(b)
+	if bytes.Equal(a, b) {
+		t.Error("different seeds produce the same stream")
+	}
+}
+
+func TestChargenReader_Read(t *testing.T) {
+	b := make([]byte, 2*74)
+	_, _ = NewChargenReader().Read(b)
+	line1 := ` !"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\]^_` + "`abcdefg\r\n"
+	line2 := `!"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\]^_` + "`abcdefgh\r\n"
+	if string(b) != line1+line2 {
+		t.Errorf("expecting %q, got %q", line1+line2, b)
+	}
+}
+
+func TestCounterReader_Read(t *testing.T) {
+	b := make([]byte, 16)
+	_, _ = NewCounterReader().Read(b)
+	expected := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expecting %v, got %v", expected, b)
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	t.Run("intact stream through a pipe", func(t *testing.T) {
+		a, b := AsyncPipe()
+		go func() {
+			_, _ = io.CopyN(a, NewPRNGReader(7), 100000)
+		}()
+		v := NewPRNGVerifier(7)
+		n, err := io.CopyN(v, b, 100000)
+		if err != nil {
+			t.Error(err)
+		}
+		if n != 100000 || v.Verified() != 100000 {
+			t.Errorf("expecting %v, got %v and %v", 100000, n, v.Verified())
+		}
+		if v.Err() != nil {
+			t.Error(v.Err())
+		}
+	})
+
+	t.Run("diverging stream", func(t *testing.T) {
+		data := make([]byte, 100)
+		_, _ = NewCounterReader().Read(data)
+		data[42] ^= 0xff
+
+		v := NewCounterVerifier()
+		_, err := v.Write(data[:20])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := v.Write(data[20:])
+		if n != 22 {
+			t.Errorf("expecting %v, got %v", 22, n)
+		}
+		var mismatch *MismatchError
+		if !errors.As(err, &mismatch) {
+			t.Fatalf("expecting a MismatchError, got %v", err)
+		}
+		if mismatch.Offset != 42 {
+			t.Errorf("expecting %v, got %v", 42, mismatch.Offset)
+		}
+		if v.Verified() != 42 {
+			t.Errorf("expecting %v, got %v", 42, v.Verified())
+		}
+		if _, err := v.Write([]byte{0}); err != mismatch {
+			t.Errorf("expecting %v, got %v", mismatch, err)
+		}
+	})
+
+	t.Run("finite expected stream", func(t *testing.T) {
+		v := NewVerifier(bytes.NewReader([]byte("hello")))
+		n, err := v.Write([]byte("hello world"))
+		if n != 5 || err == nil {
+			t.Errorf("expecting 5 bytes and an error, got %v and %v", n, err)
+		}
+	})
+}
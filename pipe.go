@@ -1,7 +1,9 @@
 package connutil
 
 import (
+	"context"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -10,31 +12,112 @@ import (
 type StreamPipe struct {
 	writeEnd *bufferedPipe
 	readEnd  *bufferedPipe
+
+	id    ConnID
+	name  string
+	hooks *Hooks
+
+	localAddr, remoteAddr net.Addr
+
+	sockOptsM sync.Mutex
+	sockOpts  SocketOptions
+	// keepAliveGen is incremented every time keepalive is reconfigured, which stops the probes already scheduled
+	keepAliveGen uint64
 }
 
+// ID returns the identity of this end of the pipe, as reported to Hooks
+func (conn *StreamPipe) ID() ConnID { return conn.id }
+
+// Name returns the name of this end of the pipe set through WithName, or the string form of its ID if there isn't one.
+func (conn *StreamPipe) Name() string { return conn.name }
+
 // Read implements net.Conn Read method. It will block until data becomes available by writing to the other end.
 func (conn *StreamPipe) Read(b []byte) (int, error) { return conn.readEnd.Read(b) }
 
+// ReadContext behaves like Read, but returns ctx.Err() once ctx is done. Unlike SetReadDeadline, it doesn't affect
+// other Read calls.
+func (conn *StreamPipe) ReadContext(ctx context.Context, b []byte) (int, error) {
+	return conn.readEnd.ReadContext(ctx, b)
+}
+
+// WriteContext behaves like Write, but returns ctx.Err() once ctx is done. Unlike SetWriteDeadline, it doesn't affect
+// other Write calls.
+func (conn *StreamPipe) WriteContext(ctx context.Context, b []byte) (int, error) {
+	return conn.writeEnd.WriteContext(ctx, b)
+}
+
 // Write implements net.Conn Read method. If a buffer size is specified using LimitedAsyncPipe, it may block
 // until data is read from the other end.
 func (conn *StreamPipe) Write(b []byte) (int, error) { return conn.writeEnd.Write(b) }
 
 // Close closes the pipe. Calling Close on either end of a pipe will close both ends.
+// If SetLinger(0) has been called, the pipe is reset instead, and I/O on both ends fails with ErrConnReset.
 func (conn *StreamPipe) Close() error {
-	conn.writeEnd.Close()
-	conn.readEnd.Close()
+	conn.sockOptsM.Lock()
+	linger := conn.sockOpts.Linger
+	conn.sockOptsM.Unlock()
+	if linger == 0 {
+		conn.closeWithError(ErrConnReset)
+	} else {
+		conn.writeEnd.Close()
+		conn.readEnd.Close()
+	}
+	conn.hooks.fire(HookEvent{Op: HookClose, Conn: conn.id})
+	return nil
+}
+
+// CloseWrite shuts down the writing side of this end, like *net.TCPConn CloseWrite method. The other end can still
+// read the data already written, after which Read returns io.EOF. Data can still be sent the other way.
+func (conn *StreamPipe) CloseWrite() error {
+	conn.writeEnd.CloseWrite()
+	return nil
+}
+
+// SetReadBuffer sets the size of the receive buffer of this end, see WithReceiveWindow. 0 means unlimited, in which
+// case data written by the other end is immediately readable. Shrinking it doesn't discard any data, but no more data
+// is received until the buffer is drained below the new size.
+func (conn *StreamPipe) SetReadBuffer(bytes int) error {
+	conn.readEnd.SetReceiveWindow(bytes)
+	return nil
+}
+
+// SetWriteBuffer sets the size of the send buffer of this end, which is the buffer size limit of LimitedAsyncPipe.
+// 0 means unlimited.
+func (conn *StreamPipe) SetWriteBuffer(bytes int) error {
+	conn.writeEnd.SetSendBuffer(bytes)
 	return nil
 }
 
+// setFrozen freezes or unfreezes both directions of the pipe
+func (conn *StreamPipe) setFrozen(frozen bool) {
+	conn.writeEnd.SetFrozen(frozen)
+	conn.readEnd.SetFrozen(frozen)
+}
+
+// finished reports whether both directions of the pipe are closed
+func (conn *StreamPipe) finished() bool {
+	writeClosed, _ := conn.writeEnd.leakState()
+	readClosed, _ := conn.readEnd.leakState()
+	return writeClosed && readClosed
+}
+
+// closeWithError closes both directions of the pipe, such that I/O on both ends fails with err
+func (conn *StreamPipe) closeWithError(err error) {
+	conn.writeEnd.CloseWithError(err)
+	conn.readEnd.CloseWithError(err)
+}
+
 // SetReadDeadline implements net.Conn SetReadDeadline method.
 func (conn *StreamPipe) SetReadDeadline(t time.Time) error {
 	conn.readEnd.SetReadDeadline(t)
+	conn.hooks.fire(HookEvent{Op: HookSetReadDeadline, Conn: conn.id, Deadline: t})
 	return nil
 }
 
 // SetWriteDeadline implements net.Conn SetWriteDeadline method.
 func (conn *StreamPipe) SetWriteDeadline(t time.Time) error {
 	conn.writeEnd.SetWriteDeadline(t)
+	conn.hooks.fire(HookEvent{Op: HookSetWriteDeadline, Conn: conn.id, Deadline: t})
 	return nil
 }
 
@@ -45,31 +128,88 @@ func (conn *StreamPipe) SetDeadline(t time.Time) error {
 	return nil
 }
 
-// LocalAddr implements net.Conn LocalAddr method. It returns a meaningless mock address.
-func (conn *StreamPipe) LocalAddr() net.Addr { return fakeAddr{} }
+// Stats returns the traffic statistics of this end of the pipe.
+func (conn *StreamPipe) Stats() Stats {
+	return Stats{
+		Sent:     conn.writeEnd.Stats(),
+		Received: conn.readEnd.Stats(),
+	}
+}
+
+// LocalAddr implements net.Conn LocalAddr method. It returns the address set through WithAddr, or a meaningless mock
+// address if there isn't one.
+func (conn *StreamPipe) LocalAddr() net.Addr { return conn.localAddr }
 
-// RemoteAddr implements net.Conn RemoteAddr method. It returns a meaningless mock address.
-func (conn *StreamPipe) RemoteAddr() net.Addr { return fakeAddr{} }
+// RemoteAddr implements net.Conn RemoteAddr method. It returns the LocalAddr of the other end.
+func (conn *StreamPipe) RemoteAddr() net.Addr { return conn.remoteAddr }
 
 // AsyncPipe is an in-memory, full-duplex pipe with both ends implementing net.Conn interface.
 //
 // It is a drop-in replacement of net.Pipe, but buffered, asynchronous and safe for concurrent use.
-func AsyncPipe() (*StreamPipe, *StreamPipe) {
-	return LimitedAsyncPipe(0)
+func AsyncPipe(opts ...PipeOption) (*StreamPipe, *StreamPipe) {
+	return NewPipe(opts...)
 }
 
 // LimitedAsyncPipe is similar to AsyncPipe, but Write calls will block if the buffer size grows larger than
 // bufferSizeLimit. Consuming data through Read calls on the other end will unblock the Write call.
-func LimitedAsyncPipe(bufferSizeLimit int) (*StreamPipe, *StreamPipe) {
-	LtoR := newBufferedPipe(bufferSizeLimit)
-	RtoL := newBufferedPipe(bufferSizeLimit)
+// See WithStrictLimit to make bufferSizeLimit a hard capacity.
+//
+// It is a shorthand for NewPipe with WithBufferSizeLimit(bufferSizeLimit) in front of opts, so opts can still override
+// the limit of either direction.
+func LimitedAsyncPipe(bufferSizeLimit int, opts ...PipeOption) (*StreamPipe, *StreamPipe) {
+	return NewPipe(append([]PipeOption{WithBufferSizeLimit(bufferSizeLimit)}, opts...)...)
+}
+
+// NewPipe creates an in-memory, full-duplex, stream-oriented pipe with both ends implementing net.Conn interface,
+// configured by opts. Without any option, it is the same as AsyncPipe.
+//
+// Each direction of the pipe can be configured independently by wrapping options in AtoB or BtoA, e.g. to simulate an
+// asymmetric link:
+//
+//	a, b := NewPipe(AtoB(WithBufferSizeLimit(1<<10)), BtoA(WithBufferSizeLimit(1<<20)))
+func NewPipe(opts ...PipeOption) (*StreamPipe, *StreamPipe) {
+	config := newPipeConfig(opts)
+	pipeID := nextPipeID()
+	aID := ConnID{Pipe: pipeID, End: 0}
+	bID := aID.peer()
+
+	LtoR := newBufferedPipe(config.dirs[dirAtoB].bufferLimit)
+	LtoR.hooks, LtoR.writer, LtoR.reader = config.hooks, aID, bID
+	RtoL := newBufferedPipe(config.dirs[dirBtoA].bufferLimit)
+	RtoL.hooks, RtoL.writer, RtoL.reader = config.hooks, bID, aID
+	for i, p := range []*bufferedPipe{LtoR, RtoL} {
+		dir := &config.dirs[i]
+		p.segmentSize, p.lowWater, p.coalesceDelay = dir.segmentSize, dir.lowWater, dir.coalesceDelay
+		p.strict, p.rcvWindow = dir.strict, dir.rcvWindow
+		if dir.segmentRand {
+			// each direction has its own sequence of sizes
+			p.segmentRand = NewPRNGReader(dir.segmentSeed + uint64(i))
+		}
+	}
+	aAddr, bAddr := config.dirs[dirAtoB].localAddr(), config.dirs[dirBtoA].localAddr()
 	a := &StreamPipe{
-		writeEnd: LtoR,
-		readEnd:  RtoL,
+		writeEnd:   LtoR,
+		readEnd:    RtoL,
+		id:         aID,
+		name:       config.dirs[dirAtoB].nameOr(aID),
+		hooks:      config.hooks,
+		localAddr:  aAddr,
+		remoteAddr: bAddr,
+		sockOpts:   defaultSocketOptions(),
 	}
 	b := &StreamPipe{
-		writeEnd: RtoL,
-		readEnd:  LtoR,
+		writeEnd:   RtoL,
+		readEnd:    LtoR,
+		id:         bID,
+		name:       config.dirs[dirBtoA].nameOr(bID),
+		hooks:      config.hooks,
+		localAddr:  bAddr,
+		remoteAddr: aAddr,
+		sockOpts:   defaultSocketOptions(),
+	}
+	if config.idleTimeout > 0 {
+		watchIdle(config.idleTimeout, func() { _ = a.Close() }, LtoR, RtoL)
 	}
+	trackPipe(config, "StreamPipe", pipeID, LtoR, RtoL)
 	return a, b
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -347,3 +348,262 @@ func TestLimitedAsyncPipe(t *testing.T) {
 		}
 	})
 }
+
+func TestPipeConn_Segmentation(t *testing.T) {
+	readSizes := func(conn *StreamPipe, total int) (sizes []int) {
+		buf := make([]byte, 1024)
+		for read := 0; read < total; {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, n)
+			read += n
+		}
+		return
+	}
+
+	t.Run("segment size", func(t *testing.T) {
+		a, b := AsyncPipe(WithSegmentSize(4))
+		_, _ = a.Write(make([]byte, 10))
+		sizes := readSizes(b, 10)
+		if fmt.Sprint(sizes) != "[4 4 2]" {
+			t.Errorf("expecting %v, got %v", "[4 4 2]", sizes)
+		}
+	})
+
+	t.Run("one byte at a time", func(t *testing.T) {
+		a, b := AsyncPipe(WithSegmentSize(1))
+		_, _ = a.Write([]byte("abc"))
+		sizes := readSizes(b, 3)
+		if len(sizes) != 3 {
+			t.Errorf("expecting %v reads, got %v", 3, len(sizes))
+		}
+	})
+
+	t.Run("random segments are reproducible", func(t *testing.T) {
+		var results []string
+		for i := 0; i < 2; i++ {
+			a, b := AsyncPipe(WithRandomSegments(42, 100))
+			_, _ = a.Write(make([]byte, 1000))
+			sizes := readSizes(b, 1000)
+			for _, size := range sizes {
+				if size < 1 || size > 100 {
+					t.Errorf("segment size %v out of range", size)
+				}
+			}
+			results = append(results, fmt.Sprint(sizes))
+		}
+		if results[0] != results[1] {
+			t.Errorf("expecting %v, got %v", results[0], results[1])
+		}
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		a, b := AsyncPipe(WithCoalescing(6, time.Second))
+		go func() {
+			for _, s := range []string{"ab", "cd", "ef"} {
+				time.Sleep(10 * time.Millisecond)
+				_, _ = a.Write([]byte(s))
+			}
+		}()
+		buf := make([]byte, 16)
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(buf[:n]) != "abcdef" {
+			t.Errorf("expecting %v, got %v", "abcdef", string(buf[:n]))
+		}
+
+		// partial data is delivered at the deadline
+		_, _ = a.Write([]byte("g"))
+		_ = b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		n, err = b.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(buf[:n]) != "g" {
+			t.Errorf("expecting %v, got %v", "g", string(buf[:n]))
+		}
+	})
+
+	t.Run("coalescing delay", func(t *testing.T) {
+		a, b := AsyncPipe(WithCoalescing(64, 20*time.Millisecond))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			// a short request without a read deadline is delivered once the delay has passed
+			_, _ = a.Write([]byte("hello"))
+			buf := make([]byte, 64)
+			n, err := b.Read(buf)
+			if err != nil || string(buf[:n]) != "hello" {
+				t.Errorf("expecting %v and no error, got %q and %v", "hello", buf[:n], err)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Read blocked beyond the coalescing delay")
+		}
+	})
+}
+
+func TestPipeConn_StrictLimit(t *testing.T) {
+	t.Run("incremental write", func(t *testing.T) {
+		a, b := LimitedAsyncPipe(1024, WithStrictLimit())
+		data := make([]byte, 100*1024)
+		rand.Read(data)
+		go func() {
+			_, _ = a.Write(data)
+		}()
+		received := make([]byte, len(data))
+		buf := make([]byte, 4096)
+		for read := 0; read < len(data); {
+			if buffered := a.Stats().Sent.Buffered; buffered > 1024 {
+				t.Fatalf("buffer grows to %v beyond the capacity", buffered)
+			}
+			n, err := b.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			copy(received[read:], buf[:n])
+			read += n
+		}
+		if !bytes.Equal(data, received) {
+			t.Error("data corrupted")
+		}
+		if peak := a.Stats().Sent.PeakBuffered; peak > 1024 {
+			t.Errorf("expecting at most %v, got %v", 1024, peak)
+		}
+	})
+
+	t.Run("partial write on deadline", func(t *testing.T) {
+		a, _ := LimitedAsyncPipe(1024, WithStrictLimit())
+		_ = a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err := a.Write(make([]byte, 4096))
+		if err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+		if n != 1024 {
+			t.Errorf("expecting %v, got %v", 1024, n)
+		}
+	})
+
+	t.Run("soft limit by default", func(t *testing.T) {
+		a, _ := LimitedAsyncPipe(1024)
+		n, err := a.Write(make([]byte, 4096))
+		if err != nil || n != 4096 {
+			t.Errorf("expecting 4096 bytes and no error, got %v and %v", n, err)
+		}
+	})
+}
+
+func TestPipeConn_ReceiveWindow(t *testing.T) {
+	t.Run("zero window stall", func(t *testing.T) {
+		a, b := LimitedAsyncPipe(100, WithReceiveWindow(50), WithStrictLimit())
+		_ = a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err := a.Write(make([]byte, 200))
+		if err != ErrTimeout {
+			t.Errorf("expecting %v, got %v", ErrTimeout, err)
+		}
+		if n != 150 {
+			t.Errorf("expecting %v, got %v", 150, n)
+		}
+		stats := a.Stats().Sent
+		if stats.ZeroWindows != 1 {
+			t.Errorf("expecting %v, got %v", 1, stats.ZeroWindows)
+		}
+		if stats.Buffered != 150 {
+			t.Errorf("expecting %v, got %v", 150, stats.Buffered)
+		}
+
+		// reading opens the window
+		buf := make([]byte, 1000)
+		n, _ = b.Read(buf)
+		if n != 50 {
+			t.Errorf("expecting %v, got %v", 50, n)
+		}
+		n, _ = b.Read(buf)
+		if n != 50 {
+			t.Errorf("expecting %v, got %v", 50, n)
+		}
+	})
+
+	t.Run("set buffers at runtime", func(t *testing.T) {
+		a, b := LimitedAsyncPipe(10, WithReceiveWindow(10))
+		_ = b.SetReadBuffer(20)
+		_ = a.SetWriteBuffer(100)
+		_, _ = a.Write(make([]byte, 100))
+		if stats := a.Stats().Sent; stats.Buffered != 100 {
+			t.Errorf("expecting %v, got %v", 100, stats.Buffered)
+		}
+		n, _ := b.Read(make([]byte, 1000))
+		if n != 20 {
+			t.Errorf("expecting %v, got %v", 20, n)
+		}
+
+		// unlimited receive buffer
+		_ = b.SetReadBuffer(0)
+		n, _ = b.Read(make([]byte, 1000))
+		if n != 80 {
+			t.Errorf("expecting %v, got %v", 80, n)
+		}
+	})
+}
+
+func TestNewPipe(t *testing.T) {
+	t.Run("asymmetric buffers", func(t *testing.T) {
+		a, b := NewPipe(WithStrictLimit(), AtoB(WithBufferSizeLimit(1024)), BtoA(WithBufferSizeLimit(4096)))
+		_ = a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err := a.Write(make([]byte, 8192))
+		if err != ErrTimeout || n != 1024 {
+			t.Errorf("expecting 1024 bytes and %v, got %v and %v", ErrTimeout, n, err)
+		}
+		_ = b.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err = b.Write(make([]byte, 8192))
+		if err != ErrTimeout || n != 4096 {
+			t.Errorf("expecting 4096 bytes and %v, got %v and %v", ErrTimeout, n, err)
+		}
+	})
+
+	t.Run("scoped options override", func(t *testing.T) {
+		a, b := LimitedAsyncPipe(1024, WithStrictLimit(), BtoA(WithBufferSizeLimit(0)))
+		n, err := b.Write(make([]byte, 8192))
+		if err != nil || n != 8192 {
+			t.Errorf("expecting 8192 bytes and no error, got %v and %v", n, err)
+		}
+		_ = a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		n, _ = a.Write(make([]byte, 8192))
+		if n != 1024 {
+			t.Errorf("expecting %v, got %v", 1024, n)
+		}
+	})
+
+	t.Run("addresses", func(t *testing.T) {
+		client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+		server := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+		a, b := NewPipe(AtoB(WithAddr(client)), BtoA(WithAddr(server)))
+		if a.LocalAddr() != client || b.RemoteAddr() != client {
+			t.Errorf("expecting %v, got %v and %v", client, a.LocalAddr(), b.RemoteAddr())
+		}
+		if b.LocalAddr() != server || a.RemoteAddr() != server {
+			t.Errorf("expecting %v, got %v and %v", server, b.LocalAddr(), a.RemoteAddr())
+		}
+
+		a, _ = NewPipe()
+		if a.LocalAddr() != (fakeAddr{}) || a.RemoteAddr() != (fakeAddr{}) {
+			t.Errorf("expecting %v, got %v and %v", fakeAddr{}, a.LocalAddr(), a.RemoteAddr())
+		}
+	})
+
+	t.Run("names", func(t *testing.T) {
+		a, b := NewPipe(AtoB(WithName("client")))
+		if a.Name() != "client" {
+			t.Errorf("expecting %v, got %v", "client", a.Name())
+		}
+		if b.Name() != b.ID().String() {
+			t.Errorf("expecting %v, got %v", b.ID().String(), b.Name())
+		}
+	})
+}
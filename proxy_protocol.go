@@ -0,0 +1,339 @@
+package connutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyHeader describes a HAProxy PROXY protocol header, as specified in
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+//
+// Source and Destination must be either *net.TCPAddr or *net.UDPAddr of the same IP family, and *net.UDPAddr needs
+// version 2. If either of them is nil, the header declares an unknown (version 1) or local (version 2) connection, and
+// the receiving end will keep using the addresses of the underlying conn.
+type ProxyHeader struct {
+	// Version is either 1 (human-readable) or 2 (binary). Default (0) means version 1.
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+func addrIPPort(addr net.Addr) (ip net.IP, port int, stream bool, ok bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			return a.IP, a.Port, true, true
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			return a.IP, a.Port, false, true
+		}
+	}
+	return nil, 0, false, false
+}
+
+// Bytes encodes the header into its wire format
+func (h ProxyHeader) Bytes() ([]byte, error) {
+	srcIP, srcPort, stream, srcOk := addrIPPort(h.Source)
+	dstIP, dstPort, dstStream, dstOk := addrIPPort(h.Destination)
+	local := !srcOk || !dstOk
+	ipv4 := srcIP.To4() != nil && dstIP.To4() != nil
+	if !local && !ipv4 && (srcIP.To16() == nil || dstIP.To16() == nil) {
+		return nil, fmt.Errorf("%w: invalid address %v or %v", ErrBadProxyHeader, h.Source, h.Destination)
+	}
+	if !local && (srcIP.To4() != nil) != (dstIP.To4() != nil) {
+		return nil, fmt.Errorf("%w: %v and %v are of different IP families", ErrBadProxyHeader, h.Source, h.Destination)
+	}
+	if !local && stream != dstStream {
+		return nil, fmt.Errorf("%w: %v and %v are of different transport protocols", ErrBadProxyHeader, h.Source,
+			h.Destination)
+	}
+
+	switch h.Version {
+	case 0, 1:
+		if local {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		if !stream {
+			return nil, fmt.Errorf("%w: version 1 can't carry UDP addresses %v and %v", ErrBadProxyHeader, h.Source,
+				h.Destination)
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcPort, dstPort)), nil
+	case 2:
+		var buf bytes.Buffer
+		buf.Write(proxyV2Signature)
+		if local {
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return buf.Bytes(), nil
+		}
+		buf.WriteByte(0x21)
+		var fam byte
+		var addrs []byte
+		if ipv4 {
+			fam = 0x10
+			addrs = append(append(addrs, srcIP.To4()...), dstIP.To4()...)
+		} else {
+			fam = 0x20
+			addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+		}
+		if stream {
+			fam |= 0x01
+		} else {
+			fam |= 0x02
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcPort))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstPort))
+		buf.WriteByte(fam)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+		buf.Write(addrs)
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported version %v", ErrBadProxyHeader, h.Version)
+	}
+}
+
+// ReadProxyHeader reads and parses a version 1 or version 2 PROXY protocol header from r. No data beyond the header is
+// consumed from r.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	// Only peek at the first byte, as a version 1 header can be shorter than the version 2 signature
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == proxyV2Signature[0] {
+		return readProxyHeaderV2(r)
+	}
+	return readProxyHeaderV1(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	// A version 1 header is at most 107 bytes long, including the CRLF
+	const maxLen = 107
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxLen {
+			return nil, fmt.Errorf("%w: header too long", ErrBadProxyHeader)
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("%w: %q", ErrBadProxyHeader, line)
+	}
+	h := &ProxyHeader{Version: 1}
+	if fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, fmt.Errorf("%w: %q", ErrBadProxyHeader, line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcOk := parseProxyPortV1(fields[4])
+	dstPort, dstOk := parseProxyPortV1(fields[5])
+	if srcIP == nil || dstIP == nil || !srcOk || !dstOk {
+		return nil, fmt.Errorf("%w: %q", ErrBadProxyHeader, line)
+	}
+	ipv4 := fields[1] == "TCP4"
+	if (srcIP.To4() != nil) != ipv4 || (dstIP.To4() != nil) != ipv4 {
+		return nil, fmt.Errorf("%w: addresses don't match %v: %q", ErrBadProxyHeader, fields[1], line)
+	}
+	h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+	h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	return h, nil
+}
+
+// parseProxyPortV1 parses a port of a version 1 header, which must not have leading zeros
+func parseProxyPortV1(s string) (int, bool) {
+	if len(s) > 1 && s[0] == '0' {
+		return 0, false
+	}
+	port, err := strconv.ParseUint(s, 10, 16)
+	return int(port), err == nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], proxyV2Signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrBadProxyHeader)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %v", ErrBadProxyHeader, fixed[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2}
+	switch fixed[12] & 0x0f {
+	case 0x0:
+		return h, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("%w: unknown command %v", ErrBadProxyHeader, fixed[12]&0x0f)
+	}
+
+	var ipLen int
+	switch fixed[13] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// unspecified or AF_UNIX, which the receiver should ignore
+		return h, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("%w: address block too short", ErrBadProxyHeader)
+	}
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+	switch fixed[13] & 0x0f {
+	case 0x1:
+		h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	case 0x2:
+		h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	default:
+		return nil, fmt.Errorf("%w: unknown transport protocol %v", ErrBadProxyHeader, fixed[13]&0x0f)
+	}
+	return h, nil
+}
+
+// ProxyDialer wraps a Dialer (typically a PipeDialer) and writes Header to every stream-oriented conn it dials, before
+// returning the conn to the caller.
+type ProxyDialer struct {
+	Dialer Dialer
+	Header ProxyHeader
+}
+
+// Dial dials through the underlying Dialer and then writes the PROXY protocol header.
+func (d *ProxyDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext acts like Dial but it may timeout or be cancelled using ctx.
+func (d *ProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: network %v is not stream-oriented", ErrBadProxyHeader, network)
+	}
+	header, err := d.Header.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ProxyListener wraps a net.Listener such that the PROXY protocol header sent by the dialing end is stripped from
+// every accepted conn.
+//
+// The header is parsed on the first call to Read, LocalAddr or RemoteAddr of the accepted conn. RemoteAddr and LocalAddr
+// then report the source and destination declared in the header. The header itself is available through ProxyHeaderOf.
+func ProxyListener(l net.Listener) net.Listener {
+	return &proxyListener{Listener: l}
+}
+
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once      sync.Once
+	header    *ProxyHeader
+	headerErr error
+}
+
+func (c *proxyConn) parse() {
+	c.once.Do(func() {
+		c.header, c.headerErr = ReadProxyHeader(c.r)
+	})
+}
+
+// ProxyHeader returns the parsed PROXY protocol header
+func (c *proxyConn) ProxyHeader() (*ProxyHeader, error) {
+	c.parse()
+	return c.header, c.headerErr
+}
+
+// ProxyHeaderOf returns the PROXY protocol header received on conn, which must be accepted from a ProxyListener. The
+// header is read from conn if it hasn't been already, and any error reading or parsing it is returned.
+func ProxyHeaderOf(conn net.Conn) (*ProxyHeader, error) {
+	c, ok := conn.(*proxyConn)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T is not accepted from a ProxyListener", ErrBadProxyHeader, conn)
+	}
+	return c.ProxyHeader()
+}
+
+// NetConn returns the underlying conn, as *tls.Conn does
+func (c *proxyConn) NetConn() net.Conn { return c.Conn }
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.parse()
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.parse()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.parse()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
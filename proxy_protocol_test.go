@@ -0,0 +1,146 @@
+package connutil
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader_RoundTrip(t *testing.T) {
+	headers := []ProxyHeader{
+		{Version: 1, Source: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}},
+		{Version: 1, Source: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		{Version: 1},
+		{Version: 2, Source: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}},
+		{Version: 2, Source: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, Destination: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53}},
+		{Version: 2},
+	}
+	for _, h := range headers {
+		encoded, err := h.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		trailing := []byte("trailing data")
+		r := bufio.NewReader(bytes.NewReader(append(encoded, trailing...)))
+		parsed, err := ReadProxyHeader(r)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", encoded, err)
+		}
+		if parsed.Version != h.Version {
+			t.Errorf("expecting version %v, got %v", h.Version, parsed.Version)
+		}
+		if (h.Source == nil) != (parsed.Source == nil) || h.Source != nil && parsed.Source.String() != h.Source.String() {
+			t.Errorf("expecting source %v, got %v", h.Source, parsed.Source)
+		}
+		if (h.Destination == nil) != (parsed.Destination == nil) || h.Destination != nil && parsed.Destination.String() != h.Destination.String() {
+			t.Errorf("expecting destination %v, got %v", h.Destination, parsed.Destination)
+		}
+		rest, _ := io.ReadAll(r)
+		if !bytes.Equal(rest, trailing) {
+			t.Errorf("data after the header was consumed: %q", rest)
+		}
+	}
+}
+
+func TestReadProxyHeader_Malformed(t *testing.T) {
+	for _, raw := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 1234\r\n",
+		"PROXY TCP4 not.an.ip 198.51.100.1 1234 443\r\n",
+		"PROXY TCP4 ::1 10.0.0.1 1 2\r\n",
+		"PROXY TCP6 1.2.3.4 5.6.7.8 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 01234 443\r\n",
+		"\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00",
+	} {
+		_, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader([]byte(raw))))
+		if !errors.Is(err, ErrBadProxyHeader) {
+			t.Errorf("expecting %v for %q, got %v", ErrBadProxyHeader, raw, err)
+		}
+	}
+}
+
+func TestProxyHeader_Bytes(t *testing.T) {
+	for _, h := range []ProxyHeader{
+		{
+			Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234},
+			Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		},
+		{
+			Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234},
+			Destination: &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+		},
+	} {
+		for _, version := range []int{1, 2} {
+			h.Version = version
+			if _, err := h.Bytes(); !errors.Is(err, ErrBadProxyHeader) {
+				t.Errorf("expecting %v for %v -> %v, got %v", ErrBadProxyHeader, h.Source, h.Destination, err)
+			}
+		}
+	}
+
+	// version 1 has no UDP
+	h := ProxyHeader{
+		Version:     1,
+		Source:      &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53},
+		Destination: &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53},
+	}
+	if _, err := h.Bytes(); !errors.Is(err, ErrBadProxyHeader) {
+		t.Errorf("expecting %v, got %v", ErrBadProxyHeader, err)
+	}
+}
+
+func TestProxyDialerListener(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	for _, version := range []int{1, 2} {
+		d, l := DialerListener(1)
+		dialer := &ProxyDialer{Dialer: d, Header: ProxyHeader{Version: version, Source: src, Destination: dst}}
+		listener := ProxyListener(l)
+
+		a, err := dialer.Dial("tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.RemoteAddr().String() != src.String() {
+			t.Errorf("expecting remote address %v, got %v", src, b.RemoteAddr())
+		}
+		if b.LocalAddr().String() != dst.String() {
+			t.Errorf("expecting local address %v, got %v", dst, b.LocalAddr())
+		}
+		header, err := ProxyHeaderOf(b)
+		if err != nil {
+			t.Error(err)
+		} else if header.Version != version || header.Source.String() != src.String() {
+			t.Errorf("expecting version %v from %v, got version %v from %v", version, src, header.Version, header.Source)
+		}
+
+		testData := []byte("hello")
+		_, _ = a.Write(testData)
+		recvBuf := make([]byte, len(testData))
+		_, err = io.ReadFull(b, recvBuf)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(testData, recvBuf) {
+			t.Errorf("expecting %q, got %q", testData, recvBuf)
+		}
+	}
+
+	d, _ := DialerListener(1)
+	dialer := &ProxyDialer{Dialer: d, Header: ProxyHeader{Version: 2, Source: src, Destination: dst}}
+	if _, err := dialer.Dial("udp", ""); !errors.Is(err, ErrBadProxyHeader) {
+		t.Errorf("expecting %v, got %v", ErrBadProxyHeader, err)
+	}
+
+	a, _ := AsyncPipe()
+	if _, err := ProxyHeaderOf(a); !errors.Is(err, ErrBadProxyHeader) {
+		t.Errorf("expecting %v, got %v", ErrBadProxyHeader, err)
+	}
+}
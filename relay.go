@@ -0,0 +1,160 @@
+package connutil
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// RelayResult reports the outcome of Relay
+type RelayResult struct {
+	// AToB is the number of bytes copied from a to b, BToA from b to a
+	AToB int64
+	BToA int64
+	// AErr is the first error from I/O on a, and BErr on b. io.EOF is not an error.
+	AErr error
+	BErr error
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type relaySide struct {
+	conn net.Conn
+	// closed is set if conn is closed by Relay in lieu of CloseWrite, so that the errors caused by that aren't reported
+	closed atomic.Bool
+	errM   sync.Mutex
+	err    error
+}
+
+func (s *relaySide) setErr(err error) {
+	s.errM.Lock()
+	defer s.errM.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+type relay struct {
+	a, b relaySide
+	// tearingDown is set once Relay starts closing conns because of an error, so that the errors caused by that aren't
+	// reported
+	tearingDown atomic.Bool
+}
+
+// reset aborts conn, so that its peer sees a connection reset if possible. Wrappers exposing the underlying conn
+// through NetConn, as *tls.Conn does, are unwrapped.
+func reset(conn net.Conn) {
+	switch c := conn.(type) {
+	case interface{ Reset() error }:
+		_ = c.Reset()
+	case interface{ SetLinger(int) error }:
+		_ = c.SetLinger(0)
+		_ = conn.Close()
+	case interface{ NetConn() net.Conn }:
+		reset(c.NetConn())
+		_ = conn.Close()
+	default:
+		_ = conn.Close()
+	}
+}
+
+// closedByPeer reports whether err is caused by the conn being closed normally, which ends a direction of the relay
+// like io.EOF does
+func closedByPeer(err error) bool {
+	return err == io.EOF || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
+
+// abort tears down both conns after an error. The error is propagated as a reset if it is one.
+func (r *relay) abort(err error) {
+	if !r.tearingDown.CompareAndSwap(false, true) {
+		return
+	}
+	if errors.Is(err, ErrConnReset) {
+		reset(r.a.conn)
+		reset(r.b.conn)
+	} else {
+		_ = r.a.conn.Close()
+		_ = r.b.conn.Close()
+	}
+}
+
+func (r *relay) copy(dst, src *relaySide) (written int64) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, rErr := src.conn.Read(buf)
+		if n > 0 {
+			nw, wErr := dst.conn.Write(buf[:n])
+			written += int64(nw)
+			if wErr != nil {
+				if dst.closed.Load() {
+					return
+				}
+				if !r.tearingDown.Load() && !closedByPeer(wErr) {
+					dst.setErr(wErr)
+				}
+				r.abort(wErr)
+				return
+			}
+		}
+		if rErr == io.EOF || closedByPeer(rErr) && !src.closed.Load() && !r.tearingDown.Load() {
+			// propagate the half-close
+			if cw, ok := dst.conn.(closeWriter); ok {
+				_ = cw.CloseWrite()
+			} else {
+				dst.closed.Store(true)
+				_ = dst.conn.Close()
+			}
+			return
+		}
+		if rErr != nil {
+			if src.closed.Load() || closedByPeer(rErr) {
+				return
+			}
+			if !r.tearingDown.Load() {
+				src.setErr(rErr)
+			}
+			r.abort(rErr)
+			return
+		}
+	}
+}
+
+// Relay copies data between a and b in both directions, until both directions are finished. It then closes a and b.
+//
+// When one side half-closes, that is, Read returns io.EOF, the other side is half-closed through CloseWrite if it
+// implements it, such as *StreamPipe, *net.TCPConn and *MuxStream, or closed otherwise. The other direction keeps
+// going. A side closed normally by its peer, on which Read fails with io.ErrClosedPipe or net.ErrClosed, is treated
+// in the same way, and isn't reported as an error.
+//
+// When I/O on either side fails, both sides are closed. If the error is a connection reset, both sides are reset
+// instead if possible, through a Reset method such as MuxStream.Reset, or SetLinger(0) such as on *StreamPipe and
+// *net.TCPConn. Wrappers exposing the underlying conn through a NetConn method, such as the conns returned by
+// BindContext and ProxyListener, are reset through the underlying conn.
+func Relay(a, b net.Conn) RelayResult {
+	r := &relay{a: relaySide{conn: a}, b: relaySide{conn: b}}
+
+	var result RelayResult
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result.AToB = r.copy(&r.b, &r.a)
+	}()
+	go func() {
+		defer wg.Done()
+		result.BToA = r.copy(&r.a, &r.b)
+	}()
+	wg.Wait()
+
+	if !r.tearingDown.Load() {
+		_ = a.Close()
+		_ = b.Close()
+	}
+	result.AErr = r.a.err
+	result.BErr = r.b.err
+	return result
+}
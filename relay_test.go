@@ -0,0 +1,166 @@
+package connutil
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	t.Run("half-close propagation", func(t *testing.T) {
+		client, relayA := AsyncPipe()
+		relayB, server := AsyncPipe()
+		done := make(chan RelayResult)
+		go func() { done <- Relay(relayA, relayB) }()
+
+		_, _ = client.Write([]byte("hello"))
+		_ = client.CloseWrite()
+		received, err := io.ReadAll(server)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(received) != "hello" {
+			t.Errorf("expecting %v, got %v", "hello", string(received))
+		}
+
+		_, _ = server.Write([]byte("world!"))
+		_ = server.CloseWrite()
+		received, err = io.ReadAll(client)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(received) != "world!" {
+			t.Errorf("expecting %v, got %v", "world!", string(received))
+		}
+
+		result := <-done
+		if result.AToB != 5 || result.BToA != 6 {
+			t.Errorf("expecting 5 and 6 bytes, got %v and %v", result.AToB, result.BToA)
+		}
+		if result.AErr != nil || result.BErr != nil {
+			t.Errorf("expecting no error, got %v and %v", result.AErr, result.BErr)
+		}
+	})
+
+	t.Run("reset propagation", func(t *testing.T) {
+		client, relayA := AsyncPipe()
+		server := Scripted(ScriptExpect([]byte("hi")), ScriptReset())
+		done := make(chan RelayResult)
+		go func() { done <- Relay(relayA, server) }()
+
+		_, _ = client.Write([]byte("hi"))
+		_, err := client.Read(make([]byte, 1))
+		if err != ErrConnReset {
+			t.Errorf("expecting %v, got %v", ErrConnReset, err)
+		}
+		result := <-done
+		if result.BErr != ErrConnReset {
+			t.Errorf("expecting %v, got %v", ErrConnReset, result.BErr)
+		}
+		if result.AErr != nil {
+			t.Errorf("expecting no error, got %v", result.AErr)
+		}
+	})
+
+	t.Run("reset propagation through a wrapper", func(t *testing.T) {
+		client, relayA := AsyncPipe()
+		server := Scripted(ScriptExpect([]byte("hi")), ScriptReset())
+		done := make(chan RelayResult)
+		go func() { done <- Relay(BindContext(relayA, context.Background()), server) }()
+
+		_, _ = client.Write([]byte("hi"))
+		if _, err := client.Read(make([]byte, 1)); err != ErrConnReset {
+			t.Errorf("expecting %v, got %v", ErrConnReset, err)
+		}
+		<-done
+	})
+
+	t.Run("peer closes", func(t *testing.T) {
+		client, relayA := AsyncPipe()
+		relayB, server := AsyncPipe()
+		done := make(chan RelayResult)
+		go func() { done <- Relay(relayA, relayB) }()
+
+		_, _ = server.Write([]byte("bye"))
+		received := make([]byte, 3)
+		_, _ = io.ReadFull(client, received)
+		_ = server.Close()
+		if _, err := client.Read(received); err != io.EOF {
+			t.Errorf("expecting %v, got %v", io.EOF, err)
+		}
+		_ = client.Close()
+		select {
+		case result := <-done:
+			if result.AErr != nil || result.BErr != nil {
+				t.Errorf("expecting no error, got %v and %v", result.AErr, result.BErr)
+			}
+		case <-time.After(time.Second):
+			t.Error("Relay did not finish")
+		}
+	})
+
+	t.Run("conn without CloseWrite", func(t *testing.T) {
+		client, relayA := AsyncPipe()
+		relayB, server := AsyncPipe()
+		wrapped := BindContext(relayB, context.Background())
+		done := make(chan RelayResult)
+		go func() { done <- Relay(relayA, wrapped) }()
+
+		_, _ = client.Write([]byte("hello"))
+		_ = client.CloseWrite()
+		received := make([]byte, 5)
+		_, _ = io.ReadFull(server, received)
+		if string(received) != "hello" {
+			t.Errorf("expecting %v, got %v", "hello", string(received))
+		}
+		select {
+		case result := <-done:
+			if result.AErr != nil || result.BErr != nil {
+				t.Errorf("expecting no error, got %v and %v", result.AErr, result.BErr)
+			}
+		case <-time.After(time.Second):
+			t.Error("Relay did not finish")
+		}
+	})
+
+	t.Run("TCP", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			data, _ := io.ReadAll(conn)
+			_, _ = conn.Write(data)
+			_ = conn.(*net.TCPConn).CloseWrite()
+		}()
+		tcpConn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, relayA := AsyncPipe()
+		done := make(chan RelayResult)
+		go func() { done <- Relay(relayA, tcpConn) }()
+		_, _ = client.Write([]byte("over tcp"))
+		_ = client.CloseWrite()
+		received, err := io.ReadAll(client)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(received) != "over tcp" {
+			t.Errorf("expecting %v, got %v", "over tcp", string(received))
+		}
+		result := <-done
+		if result.AToB != 8 || result.BToA != 8 {
+			t.Errorf("expecting 8 and 8 bytes, got %v and %v", result.AToB, result.BToA)
+		}
+	})
+}
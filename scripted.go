@@ -0,0 +1,251 @@
+package connutil
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type scriptOp int
+
+const (
+	scriptExpect scriptOp = iota
+	scriptExpectRegexp
+	scriptSend
+	scriptDelay
+	scriptClose
+	scriptReset
+)
+
+// ScriptStep is a step of the script followed by a conn created by Scripted
+type ScriptStep struct {
+	op    scriptOp
+	data  []byte
+	re    *regexp.Regexp
+	delay time.Duration
+}
+
+func (s ScriptStep) String() string {
+	switch s.op {
+	case scriptExpect:
+		return fmt.Sprintf("expect %q", s.data)
+	case scriptExpectRegexp:
+		return fmt.Sprintf("expect line matching %q", s.re)
+	case scriptSend:
+		return fmt.Sprintf("send %q", s.data)
+	case scriptDelay:
+		return fmt.Sprintf("delay %v", s.delay)
+	case scriptClose:
+		return "close"
+	case scriptReset:
+		return "reset"
+	default:
+		return "unknown step"
+	}
+}
+
+// ScriptExpect makes the script read len(b) bytes, which must be equal to b
+func ScriptExpect(b []byte) ScriptStep {
+	return ScriptStep{op: scriptExpect, data: append([]byte(nil), b...)}
+}
+
+// ScriptExpectRegexp makes the script read a line, which must match the regular expression expr. The line ending, \n
+// or \r\n, is not part of the line matched. It panics if expr cannot be compiled.
+func ScriptExpectRegexp(expr string) ScriptStep {
+	return ScriptStep{op: scriptExpectRegexp, re: regexp.MustCompile(expr)}
+}
+
+// ScriptSend makes the script write b
+func ScriptSend(b []byte) ScriptStep {
+	return ScriptStep{op: scriptSend, data: append([]byte(nil), b...)}
+}
+
+// ScriptDelay makes the script wait for d
+func ScriptDelay(d time.Duration) ScriptStep {
+	return ScriptStep{op: scriptDelay, delay: d}
+}
+
+// ScriptClose makes the script close the conn gracefully: data already sent can still be read, after which Read
+// returns io.EOF. Write returns io.ErrClosedPipe.
+func ScriptClose() ScriptStep {
+	return ScriptStep{op: scriptClose}
+}
+
+// ScriptReset makes the script abort the conn. All I/O on it fails with ErrConnReset.
+func ScriptReset() ScriptStep {
+	return ScriptStep{op: scriptReset}
+}
+
+// ScriptError reports the step at which a script has failed
+type ScriptError struct {
+	// Step is the index of the failed step
+	Step     int
+	StepDesc string
+	Err      error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("script step %d (%s): %v", e.Step, e.StepDesc, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error { return e.Err }
+
+// ScriptedConn is a net.Conn to a fake peer following a script. It is created by Scripted.
+type ScriptedConn struct {
+	*StreamPipe
+	peer  *StreamPipe
+	steps []ScriptStep
+	done  chan struct{}
+	err   error
+	// abort is closed by ScriptedTB to stop a script still running when the test completes
+	abort chan struct{}
+}
+
+var errScriptUnfinished = errors.New("script not finished when the test completed")
+
+// Scripted returns a net.Conn whose peer follows the steps given, such as
+//
+//	Scripted(
+//		ScriptExpectRegexp(`^HELO \w+$`),
+//		ScriptSend([]byte("250 OK\r\n")),
+//		ScriptDelay(100*time.Millisecond),
+//		ScriptClose(),
+//	)
+//
+// If a step fails, for example if the data read is not as expected, the script stops and the conn is closed. Use
+// Done and Err to find out the outcome, or ScriptedTB to have it reported to a test.
+func Scripted(steps ...ScriptStep) *ScriptedConn {
+	a, b := AsyncPipe()
+	c := &ScriptedConn{
+		StreamPipe: a,
+		peer:       b,
+		steps:      steps,
+		done:       make(chan struct{}),
+		abort:      make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// ScriptedTB is similar to Scripted, but reports the failure of the script to tb. The script is checked when tb and
+// all of its subtests complete. A script not finished by then is stopped, and reported as failed at the step it was
+// on.
+func ScriptedTB(tb testing.TB, steps ...ScriptStep) *ScriptedConn {
+	c := Scripted(steps...)
+	tb.Cleanup(func() {
+		select {
+		case <-c.done:
+		default:
+			close(c.abort)
+			// unblock the script
+			_ = c.Close()
+			<-c.done
+		}
+		if c.err != nil {
+			tb.Error(c.err)
+		}
+	})
+	return c
+}
+
+// Done returns a channel that is closed when the script finishes or fails
+func (c *ScriptedConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns a *ScriptError if the script has failed, or nil if it has finished successfully or is still running
+func (c *ScriptedConn) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *ScriptedConn) run() {
+	defer close(c.done)
+	r := bufio.NewReader(c.peer)
+	for i, step := range c.steps {
+		err := c.aborted()
+		if err == nil {
+			err = c.runStep(r, step)
+		}
+		if err != nil {
+			if c.aborted() != nil {
+				// the step failed because the script has been stopped
+				err = errScriptUnfinished
+			}
+			c.err = &ScriptError{Step: i, StepDesc: step.String(), Err: err}
+			_ = c.peer.Close()
+			return
+		}
+	}
+}
+
+// aborted returns errScriptUnfinished if the script has been stopped by ScriptedTB
+func (c *ScriptedConn) aborted() error {
+	select {
+	case <-c.abort:
+		return errScriptUnfinished
+	default:
+		return nil
+	}
+}
+
+func (c *ScriptedConn) runStep(r *bufio.Reader, step ScriptStep) error {
+	switch step.op {
+	case scriptExpect:
+		return expect(r, step.data)
+	case scriptExpectRegexp:
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("got %q, then %w", line, err)
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if !step.re.MatchString(line) {
+			return fmt.Errorf("line %q does not match", line)
+		}
+	case scriptSend:
+		if _, err := c.peer.Write(step.data); err != nil {
+			return err
+		}
+	case scriptDelay:
+		timer := time.NewTimer(step.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.abort:
+			return errScriptUnfinished
+		}
+	case scriptClose:
+		c.peer.writeEnd.CloseWrite()
+		c.peer.readEnd.Close()
+	case scriptReset:
+		c.peer.closeWithError(ErrConnReset)
+	}
+	return nil
+}
+
+// expect reads len(expected) bytes from r. It returns as soon as the data read differs from expected, so that a
+// script isn't left waiting for data that can never match.
+func expect(r *bufio.Reader, expected []byte) error {
+	got := make([]byte, len(expected))
+	n := 0
+	for n < len(expected) {
+		nn, err := r.Read(got[n:])
+		n += nn
+		if !bytes.Equal(got[:n], expected[:n]) {
+			return fmt.Errorf("expecting %q, got %q", expected, got[:n])
+		}
+		if err != nil {
+			return fmt.Errorf("got %q, then %w", got[:n], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package connutil
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScripted(t *testing.T) {
+	t.Run("successful script", func(t *testing.T) {
+		conn := ScriptedTB(t,
+			ScriptExpectRegexp(`^HELO \w+$`),
+			ScriptSend([]byte("250 OK\r\n")),
+			ScriptExpect([]byte("QUIT")),
+			ScriptDelay(10*time.Millisecond),
+			ScriptSend([]byte("221 Bye\r\n")),
+			ScriptClose(),
+		)
+		_, _ = conn.Write([]byte("HELO example\r\n"))
+		r := bufio.NewReader(conn)
+		line, _ := r.ReadString('\n')
+		if line != "250 OK\r\n" {
+			t.Errorf("expecting %q, got %q", "250 OK\r\n", line)
+		}
+		_, _ = conn.Write([]byte("QUIT"))
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(rest) != "221 Bye\r\n" {
+			t.Errorf("expecting %q, got %q", "221 Bye\r\n", rest)
+		}
+		<-conn.Done()
+		if conn.Err() != nil {
+			t.Error(conn.Err())
+		}
+	})
+
+	t.Run("unexpected bytes", func(t *testing.T) {
+		conn := Scripted(ScriptExpect([]byte("hello")), ScriptSend([]byte("world")))
+		_, _ = conn.Write([]byte("help"))
+		select {
+		case <-conn.Done():
+		case <-time.After(time.Second):
+			t.Fatal("script did not fail on mismatch")
+		}
+		var scriptErr *ScriptError
+		if !errors.As(conn.Err(), &scriptErr) {
+			t.Fatalf("expecting a ScriptError, got %v", conn.Err())
+		}
+		if scriptErr.Step != 0 {
+			t.Errorf("expecting %v, got %v", 0, scriptErr.Step)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+			t.Errorf("expecting %v, got %v", io.ErrClosedPipe, err)
+		}
+	})
+
+	t.Run("unmatched line", func(t *testing.T) {
+		conn := Scripted(ScriptSend([]byte("hi\n")), ScriptExpectRegexp(`^\d+$`))
+		_, _ = conn.Write([]byte("abc\n"))
+		<-conn.Done()
+		var scriptErr *ScriptError
+		if !errors.As(conn.Err(), &scriptErr) || scriptErr.Step != 1 {
+			t.Errorf("expecting a ScriptError at step 1, got %v", conn.Err())
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		conn := Scripted(ScriptReset())
+		<-conn.Done()
+		if _, err := conn.Read(make([]byte, 1)); err != ErrConnReset {
+			t.Errorf("expecting %v, got %v", ErrConnReset, err)
+		}
+		if _, err := conn.Write([]byte{0}); err != ErrConnReset {
+			t.Errorf("expecting %v, got %v", ErrConnReset, err)
+		}
+	})
+
+	t.Run("unfinished script", func(t *testing.T) {
+		conn := Scripted(ScriptExpect([]byte("hello")))
+		if conn.Err() != nil {
+			t.Errorf("expecting no error while running, got %v", conn.Err())
+		}
+		_ = conn.Close()
+		<-conn.Done()
+		if conn.Err() == nil {
+			t.Error("expecting an error after the conn is closed mid-script")
+		}
+	})
+
+	t.Run("unfinished script reported", func(t *testing.T) {
+		tb := &recordingTB{TB: t}
+		conn := ScriptedTB(tb,
+			ScriptSend([]byte("go")),
+			ScriptDelay(10*time.Second),
+			ScriptClose(),
+		)
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		tb.runCleanups()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("expecting the delay to be cut short, took %v", elapsed)
+		}
+		if !strings.Contains(tb.errors, "script step 1 (delay 10s)") || !strings.Contains(tb.errors, "not finished") {
+			t.Errorf("expecting the unfinished step to be reported, got %q", tb.errors)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package connutil
+
+// DirectionStats holds the traffic statistics of one direction of a pipe.
+type DirectionStats struct {
+	BytesWritten int64
+	BytesRead    int64
+	// PacketsWritten and PacketsRead count datagrams on a PacketPipe, and successful Write and Read calls on a
+	// StreamPipe.
+	PacketsWritten int64
+	PacketsRead    int64
+	// Buffered is the number of bytes written but not yet read
+	Buffered int
+	// PeakBuffered is the largest Buffered has ever been
+	PeakBuffered int
+	// WriteBlocks is the number of Write calls that had to wait for the buffer size limit
+	WriteBlocks   int64
+	ReadTimeouts  int64
+	WriteTimeouts int64
+	// Dropped is the number of packets silently dropped because the buffer is full
+	Dropped int64
+	// ZeroWindows is the number of times data is held back in the send buffer because the receive window is closed.
+	// It only applies to stream pipes with a receive window.
+	ZeroWindows int64
+}
+
+func (s DirectionStats) add(other DirectionStats) DirectionStats {
+	s.BytesWritten += other.BytesWritten
+	s.BytesRead += other.BytesRead
+	s.PacketsWritten += other.PacketsWritten
+	s.PacketsRead += other.PacketsRead
+	s.Buffered += other.Buffered
+	if other.PeakBuffered > s.PeakBuffered {
+		s.PeakBuffered = other.PeakBuffered
+	}
+	s.WriteBlocks += other.WriteBlocks
+	s.ReadTimeouts += other.ReadTimeouts
+	s.WriteTimeouts += other.WriteTimeouts
+	s.Dropped += other.Dropped
+	s.ZeroWindows += other.ZeroWindows
+	return s
+}
+
+// Stats holds the traffic statistics of one end of a pipe.
+//
+// When aggregated over multiple pipes by PipeDialer.Stats and PipeListener.Stats, all fields are summed up, except
+// PeakBuffered which is the largest peak of any single pipe.
+type Stats struct {
+	// Sent is the direction from this end to the other end
+	Sent DirectionStats
+	// Received is the direction from the other end to this end
+	Received DirectionStats
+}
+
+func (s Stats) add(other Stats) Stats {
+	s.Sent = s.Sent.add(other.Sent)
+	s.Received = s.Received.add(other.Received)
+	return s
+}
+
+type statser interface {
+	Stats() Stats
+}
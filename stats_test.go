@@ -0,0 +1,116 @@
+package connutil
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamPipe_Stats(t *testing.T) {
+	a, b := LimitedAsyncPipe(16)
+	_, _ = a.Write(make([]byte, 10))
+	_, _ = a.Write(make([]byte, 10))
+
+	unblocked := make(chan struct{})
+	go func() {
+		_, _ = a.Write(make([]byte, 10))
+		close(unblocked)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, _ = io.ReadFull(b, make([]byte, 20))
+	<-unblocked
+
+	_ = b.SetReadDeadline(time.Now().Add(-1 * time.Second))
+	_, _ = b.Read(make([]byte, 1))
+
+	stats := a.Stats()
+	if stats.Sent.BytesWritten != 30 || stats.Sent.PacketsWritten != 3 {
+		t.Errorf("expecting 30 bytes in 3 writes, got %v bytes in %v writes", stats.Sent.BytesWritten, stats.Sent.PacketsWritten)
+	}
+	if stats.Sent.BytesRead != 20 {
+		t.Errorf("expecting 20 bytes read, got %v", stats.Sent.BytesRead)
+	}
+	if stats.Sent.Buffered != 10 {
+		t.Errorf("expecting 10 bytes buffered, got %v", stats.Sent.Buffered)
+	}
+	if stats.Sent.PeakBuffered != 20 {
+		t.Errorf("expecting a peak of 20 bytes buffered, got %v", stats.Sent.PeakBuffered)
+	}
+	if stats.Sent.WriteBlocks != 1 {
+		t.Errorf("expecting 1 blocked write, got %v", stats.Sent.WriteBlocks)
+	}
+	if stats.Sent.ReadTimeouts != 1 {
+		t.Errorf("expecting 1 read timeout, got %v", stats.Sent.ReadTimeouts)
+	}
+	if b.Stats().Received != stats.Sent {
+		t.Error("the two ends of a pipe should see the same stats of a direction")
+	}
+}
+
+func TestPacketPipe_Stats(t *testing.T) {
+	a, b := AsyncPacketPipe()
+	_, _ = a.Write(make([]byte, 10))
+	_, _ = a.Write(make([]byte, 20))
+	_, _ = b.Read(make([]byte, 20))
+
+	_ = a.SetWriteDeadline(time.Now().Add(-1 * time.Second))
+	_, _ = a.Write(make([]byte, 10))
+
+	stats := a.Stats()
+	if stats.Sent.PacketsWritten != 2 || stats.Sent.PacketsRead != 1 {
+		t.Errorf("expecting 2 packets written and 1 read, got %v and %v", stats.Sent.PacketsWritten, stats.Sent.PacketsRead)
+	}
+	if stats.Sent.Buffered != 20 {
+		t.Errorf("expecting 20 bytes buffered, got %v", stats.Sent.Buffered)
+	}
+	if stats.Sent.WriteTimeouts != 1 {
+		t.Errorf("expecting 1 write timeout, got %v", stats.Sent.WriteTimeouts)
+	}
+}
+
+func TestDialerListener_Stats(t *testing.T) {
+	d, l := DialerListener(4)
+	for i := 0; i < 3; i++ {
+		a, _ := d.Dial("tcp", "")
+		_, _ = a.Write(make([]byte, 100))
+		if i == 0 {
+			_ = a.Close()
+		}
+	}
+	p, _ := d.Dial("udp", "")
+	_, _ = p.Write(make([]byte, 100))
+
+	stats := d.Stats()
+	if stats.Sent.BytesWritten != 400 {
+		t.Errorf("expecting 400 bytes sent, got %v", stats.Sent.BytesWritten)
+	}
+	if stats.Sent.PacketsWritten != 4 {
+		t.Errorf("expecting 4 writes, got %v", stats.Sent.PacketsWritten)
+	}
+	if l.Stats().Received.Buffered != 400 {
+		t.Errorf("expecting 400 bytes buffered towards the listener, got %v", l.Stats().Received.Buffered)
+	}
+}
+
+func TestDialerListener_StatsOfClosedPipes(t *testing.T) {
+	d, l := DialerListener(1)
+	for i := 0; i < 100; i++ {
+		a, _ := d.Dial("tcp", "")
+		b, _ := l.Accept()
+		_, _ = a.Write(make([]byte, 10))
+		_, _ = b.Read(make([]byte, 10))
+		_ = a.Close()
+	}
+	if stats := d.Stats(); stats.Sent.BytesWritten != 1000 {
+		t.Errorf("expecting %v, got %v", 1000, stats.Sent.BytesWritten)
+	}
+	if stats := l.Stats(); stats.Received.BytesRead != 1000 {
+		t.Errorf("expecting %v, got %v", 1000, stats.Received.BytesRead)
+	}
+	l.connsM.Lock()
+	retained := len(l.dialed) + len(l.accepted)
+	l.connsM.Unlock()
+	if retained != 0 {
+		t.Errorf("expecting closed pipes to be dropped, got %v retained", retained)
+	}
+}
@@ -0,0 +1,104 @@
+package connutil
+
+import (
+	"net"
+	"time"
+)
+
+// The methods below mirror those of *net.TCPConn, so that code written against it can run over a StreamPipe.
+// The settings made through them can be inspected through StreamPipe.SocketOptions.
+
+// SocketOptions are the settings of one end of a StreamPipe, made through the methods mirroring those of *net.TCPConn
+type SocketOptions struct {
+	// NoDelay is true by default, as it is for *net.TCPConn
+	NoDelay         bool
+	KeepAlive       bool
+	KeepAlivePeriod time.Duration
+	KeepAliveConfig net.KeepAliveConfig
+	// Linger is -1 by default
+	Linger int
+	// ReadBuffer is the size of the receive buffer, 0 means unlimited
+	ReadBuffer int
+	// WriteBuffer is the size of the send buffer, 0 means unlimited
+	WriteBuffer int
+}
+
+func defaultSocketOptions() SocketOptions {
+	return SocketOptions{NoDelay: true, Linger: -1}
+}
+
+// SocketOptions returns the current settings of this end of the pipe
+func (conn *StreamPipe) SocketOptions() SocketOptions {
+	conn.sockOptsM.Lock()
+	opts := conn.sockOpts
+	conn.sockOptsM.Unlock()
+
+	conn.readEnd.mu.Lock()
+	opts.ReadBuffer = conn.readEnd.rcvWindow
+	conn.readEnd.mu.Unlock()
+	conn.writeEnd.mu.Lock()
+	opts.WriteBuffer = conn.writeEnd.softLimit
+	conn.writeEnd.mu.Unlock()
+	return opts
+}
+
+func (conn *StreamPipe) setSocketOptions(set func(*SocketOptions)) error {
+	conn.sockOptsM.Lock()
+	defer conn.sockOptsM.Unlock()
+	set(&conn.sockOpts)
+	return nil
+}
+
+// SetNoDelay mirrors the *net.TCPConn SetNoDelay method. It has no effect on how data is delivered, see
+// WithCoalescing for that.
+func (conn *StreamPipe) SetNoDelay(noDelay bool) error {
+	return conn.setSocketOptions(func(opts *SocketOptions) { opts.NoDelay = noDelay })
+}
+
+// SetKeepAlive mirrors the *net.TCPConn SetKeepAlive method. With keepalive enabled, I/O on this end fails with
+// ErrConnTimedOut once the peer is found to have vanished, that is, the pipe is frozen (see EstablishedFreeze) and
+// nothing has been received for the idle time plus count times the interval. The other end is not told. See
+// SetKeepAliveConfig for the parameters.
+func (conn *StreamPipe) SetKeepAlive(keepalive bool) error {
+	return conn.setSocketOptions(func(opts *SocketOptions) {
+		opts.KeepAlive = keepalive
+		conn.restartKeepAlive()
+	})
+}
+
+// SetKeepAlivePeriod mirrors the *net.TCPConn SetKeepAlivePeriod method. It sets the idle time before the first
+// keepalive probe.
+func (conn *StreamPipe) SetKeepAlivePeriod(d time.Duration) error {
+	return conn.setSocketOptions(func(opts *SocketOptions) {
+		opts.KeepAlivePeriod = d
+		conn.restartKeepAlive()
+	})
+}
+
+// SetKeepAliveConfig mirrors the *net.TCPConn SetKeepAliveConfig method. The defaults of Idle, Interval and Count are
+// 15s, 15s and 9.
+func (conn *StreamPipe) SetKeepAliveConfig(config net.KeepAliveConfig) error {
+	return conn.setSocketOptions(func(opts *SocketOptions) {
+		opts.KeepAliveConfig = config
+		opts.KeepAlive = config.Enable
+		conn.restartKeepAlive()
+	})
+}
+
+// SetLinger mirrors the *net.TCPConn SetLinger method. If sec is 0, Close resets the connection instead of closing it
+// gracefully: pending data is discarded, and I/O on both ends fails with ErrConnReset.
+func (conn *StreamPipe) SetLinger(sec int) error {
+	return conn.setSocketOptions(func(opts *SocketOptions) { opts.Linger = sec })
+}
+
+// CloseRead mirrors the *net.TCPConn CloseRead method. Read on this end returns io.EOF afterwards, and data written by
+// the other end is discarded.
+func (conn *StreamPipe) CloseRead() error {
+	conn.readEnd.CloseRead()
+	return nil
+}
+
+// MultipathTCP mirrors the *net.TCPConn MultipathTCP method. It always reports false.
+func (conn *StreamPipe) MultipathTCP() (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,86 @@
+package connutil
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpConn is the set of *net.TCPConn methods StreamPipe mirrors
+type tcpConn interface {
+	net.Conn
+	SetNoDelay(bool) error
+	SetKeepAlive(bool) error
+	SetKeepAlivePeriod(time.Duration) error
+	SetKeepAliveConfig(net.KeepAliveConfig) error
+	SetLinger(int) error
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+	CloseRead() error
+	CloseWrite() error
+	MultipathTCP() (bool, error)
+}
+
+var (
+	_ tcpConn = (*net.TCPConn)(nil)
+	_ tcpConn = (*StreamPipe)(nil)
+)
+
+func TestStreamPipe_SocketOptions(t *testing.T) {
+	a, _ := LimitedAsyncPipe(1024)
+	defer a.Close()
+	opts := a.SocketOptions()
+	if !opts.NoDelay || opts.Linger != -1 || opts.WriteBuffer != 1024 {
+		t.Errorf("unexpected default options %+v", opts)
+	}
+
+	_ = a.SetNoDelay(false)
+	_ = a.SetKeepAlive(true)
+	_ = a.SetKeepAlivePeriod(15 * time.Second)
+	_ = a.SetReadBuffer(4096)
+	_ = a.SetWriteBuffer(8192)
+	opts = a.SocketOptions()
+	expected := SocketOptions{
+		NoDelay:         false,
+		KeepAlive:       true,
+		KeepAlivePeriod: 15 * time.Second,
+		Linger:          -1,
+		ReadBuffer:      4096,
+		WriteBuffer:     8192,
+	}
+	if opts != expected {
+		t.Errorf("expecting %+v, got %+v", expected, opts)
+	}
+}
+
+func TestStreamPipe_SetLinger(t *testing.T) {
+	a, b := AsyncPipe()
+	_, _ = a.Write([]byte("pending"))
+	_ = a.SetLinger(0)
+	_ = a.Close()
+	if _, err := b.Read(make([]byte, 16)); err != ErrConnReset {
+		t.Errorf("expecting %v, got %v", ErrConnReset, err)
+	}
+	if _, err := b.Write([]byte{0}); err != ErrConnReset {
+		t.Errorf("expecting %v, got %v", ErrConnReset, err)
+	}
+}
+
+func TestStreamPipe_CloseRead(t *testing.T) {
+	a, b := AsyncPipe()
+	defer a.Close()
+	_ = a.CloseRead()
+	if _, err := a.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expecting %v, got %v", io.EOF, err)
+	}
+	if n, err := b.Write([]byte("discarded")); err != nil || n != 9 {
+		t.Errorf("expecting 9 bytes and no error, got %v and %v", n, err)
+	}
+	// the other direction is unaffected
+	_, _ = a.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "hi" {
+		t.Errorf("expecting %v, got %v and %v", "hi", string(buf), err)
+	}
+}
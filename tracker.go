@@ -0,0 +1,155 @@
+package connutil
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// trackerGracePeriod is how long Check waits for background goroutines to exit after their conns are closed
+const trackerGracePeriod = 100 * time.Millisecond
+
+// Tracker detects leaked pipes and background goroutines. See Track, WithTracker and EchoTracker.
+type Tracker struct {
+	mu    sync.Mutex
+	items []*trackedItem
+	// pruneAt is the number of items at which the ones no longer leaking are removed
+	pruneAt int
+}
+
+type trackedItem struct {
+	desc  string
+	stack []byte
+	// leaked returns a description of the leak, or "" if there isn't one
+	leaked func() string
+}
+
+// NewTracker creates a Tracker. Pass it to WithTracker to track the pipes created with the option, and to EchoTracker
+// to track the goroutines of Echoer, PacketEchoer and EchoServer.
+func NewTracker() *Tracker {
+	return &Tracker{pruneAt: 64}
+}
+
+// Track creates a Tracker which is checked when tb completes. It fails tb if any of the objects tracked has been
+// leaked, that is, a pipe that was never closed, or an Echoer goroutine that is still running. The stack trace of
+// where each leaked object is created is listed.
+//
+// Only the objects created with the Tracker are tracked, so tests running in parallel don't see each other's objects.
+// Pass it to WithTracker for pipes, including the ones created by DialerListener and Intercept, and to EchoTracker for
+// Echoer, PacketEchoer and EchoServer.
+func Track(tb testing.TB) *Tracker {
+	tb.Helper()
+	tr := NewTracker()
+	tb.Cleanup(func() {
+		if err := tr.Check(); err != nil {
+			tb.Error(err)
+		}
+	})
+	return tr
+}
+
+func (tr *Tracker) add(item *trackedItem) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.items = append(tr.items, item)
+	if len(tr.items) >= tr.pruneAt {
+		tr.prune()
+	}
+}
+
+// prune must be called with tr.mu held. It removes the items closed or exited, which can't leak any more, so that a
+// Tracker used for a long time doesn't keep every object ever tracked.
+func (tr *Tracker) prune() {
+	n := 0
+	for _, item := range tr.items {
+		if item.leaked() != "" {
+			tr.items[n] = item
+			n++
+		}
+	}
+	for i := n; i < len(tr.items); i++ {
+		tr.items[i] = nil
+	}
+	tr.items = tr.items[:n]
+	// prune again once the number of items doubles, so that adding items takes amortised constant time
+	tr.pruneAt = 2 * n
+	if tr.pruneAt < 64 {
+		tr.pruneAt = 64
+	}
+}
+
+// Check returns an error listing every leak found, or nil if there isn't any
+func (tr *Tracker) Check() error {
+	tr.mu.Lock()
+	items := append([]*trackedItem(nil), tr.items...)
+	tr.mu.Unlock()
+
+	var leaks []string
+	deadline := time.Now().Add(trackerGracePeriod)
+	for _, item := range items {
+		leak := item.leaked()
+		for leak != "" && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+			leak = item.leaked()
+		}
+		if leak != "" {
+			leaks = append(leaks, fmt.Sprintf("%s %s, created at:\n%s", item.desc, leak, item.stack))
+		}
+	}
+	if len(leaks) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d leaks found:\n%s", len(leaks), strings.Join(leaks, "\n"))
+}
+
+// track registers an object with tr, if there is one
+func track(tr *Tracker, desc string, leaked func() string) {
+	if tr == nil {
+		return
+	}
+	tr.add(&trackedItem{desc: desc, stack: debug.Stack(), leaked: leaked})
+}
+
+type leakStater interface {
+	leakState() (closed bool, waiting int)
+}
+
+// trackPipe tracks a pipe, which is leaked if it is never closed
+func trackPipe(config *pipeConfig, kind string, pipeID uint64, directions ...leakStater) {
+	desc := fmt.Sprintf("%s pipe%d", kind, pipeID)
+	if a, b := config.dirs[dirAtoB].name, config.dirs[dirBtoA].name; a != "" || b != "" {
+		desc += fmt.Sprintf(" (%s <-> %s)", config.dirs[dirAtoB].nameOr(ConnID{Pipe: pipeID, End: 0}),
+			config.dirs[dirBtoA].nameOr(ConnID{Pipe: pipeID, End: 1}))
+	}
+	track(config.tracker, desc, func() string {
+		closed := true
+		waiting := 0
+		for _, direction := range directions {
+			c, w := direction.leakState()
+			closed = closed && c
+			waiting += w
+		}
+		if closed {
+			return ""
+		}
+		if waiting > 0 {
+			return fmt.Sprintf("not closed, with %d goroutines blocked in Read or Write", waiting)
+		}
+		return "not closed"
+	})
+}
+
+// trackGoroutine tracks a background goroutine, which is leaked if done isn't closed
+func trackGoroutine(tr *Tracker, desc string, done <-chan struct{}) {
+	track(tr, desc, func() string {
+		select {
+		case <-done:
+			return ""
+		default:
+			return "goroutine still running"
+		}
+	})
+}
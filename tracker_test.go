@@ -0,0 +1,149 @@
+package connutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	t.Run("closed pipes", func(t *testing.T) {
+		tr := NewTracker()
+		a, _ := AsyncPipe(WithTracker(tr))
+		_ = a.Close()
+		c, _ := AsyncPacketPipe(WithTracker(tr))
+		_ = c.Close()
+		if err := tr.Check(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("leaked pipe", func(t *testing.T) {
+		tr := NewTracker()
+		a, _ := AsyncPipe(WithTracker(tr))
+		done := make(chan struct{})
+		go func() {
+			_, _ = a.Read(make([]byte, 1))
+			close(done)
+		}()
+		err := tr.Check()
+		if err == nil {
+			t.Fatal("expecting a leak")
+		}
+		if !strings.Contains(err.Error(), "1 goroutines blocked") {
+			t.Errorf("expecting the blocked goroutine to be reported, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "TestTracker") {
+			t.Errorf("expecting the creation stack trace, got %v", err)
+		}
+		_ = a.Close()
+		<-done
+	})
+
+	t.Run("named pipe", func(t *testing.T) {
+		tr := NewTracker()
+		a, _ := NewPipe(WithTracker(tr), AtoB(WithName("client")), BtoA(WithName("server")))
+		err := tr.Check()
+		if err == nil || !strings.Contains(err.Error(), "(client <-> server)") {
+			t.Errorf("expecting the names to be reported, got %v", err)
+		}
+		_ = a.Close()
+	})
+
+	t.Run("leaked echoer", func(t *testing.T) {
+		tr := NewTracker()
+		e := Echoer(EchoTracker(tr))
+		err := tr.Check()
+		if err == nil || !strings.Contains(err.Error(), "Echoer goroutine still running") {
+			t.Errorf("expecting the Echoer to be reported, got %v", err)
+		}
+		_ = e.Close()
+		if err := tr.Check(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("untracked", func(t *testing.T) {
+		tr := NewTracker()
+		a, _ := AsyncPipe()
+		e := Echoer()
+		if err := tr.Check(); err != nil {
+			t.Errorf("expecting objects created without the tracker to be ignored, got %v", err)
+		}
+		_ = a.Close()
+		_ = e.Close()
+	})
+
+	t.Run("cancelled dial", func(t *testing.T) {
+		tr := NewTracker()
+		d, _ := DialerListener(0, WithTracker(tr))
+		for _, network := range []string{"tcp", "udp"} {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			if _, err := d.DialContext(ctx, network, ""); err != context.DeadlineExceeded {
+				t.Errorf("expecting %v, got %v", context.DeadlineExceeded, err)
+			}
+			cancel()
+		}
+		if err := tr.Check(); err != nil {
+			t.Errorf("expecting pipes never handed out to be closed, got %v", err)
+		}
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		tr := NewTracker()
+		for i := 0; i < 1000; i++ {
+			a, _ := AsyncPipe(WithTracker(tr))
+			_ = a.Close()
+		}
+		tr.mu.Lock()
+		n := len(tr.items)
+		tr.mu.Unlock()
+		if n >= 64 {
+			t.Errorf("expecting closed pipes to be removed, got %v items", n)
+		}
+	})
+
+	t.Run("Track", func(t *testing.T) {
+		tr := Track(t)
+		d, l := DialerListener(0, WithTracker(tr))
+		go func() { _ = EchoServer(l, EchoTracker(tr)) }()
+		conn, err := d.Dial("tcp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+		_ = l.Close()
+		e := Echoer(EchoTracker(tr))
+		_ = e.Close()
+	})
+
+	t.Run("Track reports leaks", func(t *testing.T) {
+		tb := &recordingTB{TB: t}
+		tr := Track(tb)
+		a, _ := AsyncPipe(WithTracker(tr))
+		tb.runCleanups()
+		if !strings.Contains(tb.errors, "not closed") {
+			t.Errorf("expecting the leaked pipe to be reported, got %q", tb.errors)
+		}
+		_ = a.Close()
+	})
+}
+
+// recordingTB records the errors reported to it, and runs the cleanup functions on demand
+type recordingTB struct {
+	testing.TB
+	errors   string
+	cleanups []func()
+}
+
+func (tb *recordingTB) Error(args ...any) { tb.errors += fmt.Sprint(args...) }
+
+func (tb *recordingTB) Cleanup(f func()) { tb.cleanups = append(tb.cleanups, f) }
+
+func (tb *recordingTB) runCleanups() {
+	for i := len(tb.cleanups) - 1; i >= 0; i-- {
+		tb.cleanups[i]()
+	}
+}